@@ -0,0 +1,467 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backup copies the whole database to destPath. If destPath ends in
+// ".tar.gz" or ".tgz" a gzipped tarball is written, otherwise destPath is
+// created as a directory mirroring the database.
+//
+// Every collection that exists when Backup starts is read-locked for the
+// duration of the copy, so the snapshot contains no half-finished writes and
+// no collection changes while it is copied; writers wait until the backup is
+// done. Collections created after Backup starts are not included. Leftover
+// temp files from interrupted writes are skipped.
+func (d *Driver) Backup(destPath string) error {
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+
+	dest, err := filepath.Abs(destPath)
+	if err != nil {
+		return err
+	}
+	root, err := filepath.Abs(d.dir)
+	if err != nil {
+		return err
+	}
+	if isWithin(root, dest) {
+		return fmt.Errorf("backup destination %v is inside the database", destPath)
+	}
+
+	unlock, err := d.rlockAll()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if isArchive(dest) {
+		return d.archive(dest)
+	}
+	return d.copyTree(dest)
+}
+
+// snapshotLayout timestamps SnapshotTo's archives. It is fixed width, so
+// the names sort in time order.
+const snapshotLayout = "snapshot-20060102T150405.000000000Z.tar.gz"
+
+// SnapshotTo writes a Backup archive into dir, named after the current UTC
+// time, and then deletes all but the newest keep snapshots there. Age is
+// read from the time in each name, not from the file's mtime, and files
+// that aren't snapshots are left alone. A keep of zero or less keeps every
+// snapshot.
+func (d *Driver) SnapshotTo(dir string, keep int) error {
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, d.dirPerm); err != nil {
+		return err
+	}
+
+	name := time.Now().UTC().Format(snapshotLayout)
+	if err := d.Backup(filepath.Join(dir, name)); err != nil {
+		return err
+	}
+
+	if keep <= 0 {
+		return nil
+	}
+	return pruneSnapshots(dir, keep)
+}
+
+// pruneSnapshots deletes all but the newest keep snapshots in dir.
+func pruneSnapshots(dir string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	type snapshot struct {
+		name  string
+		taken time.Time
+	}
+	var snapshots []snapshot
+	for _, entry := range entries {
+		taken, err := time.Parse(snapshotLayout, entry.Name())
+		if err != nil || !entry.Type().IsRegular() {
+			continue
+		}
+		snapshots = append(snapshots, snapshot{entry.Name(), taken})
+	}
+	if len(snapshots) <= keep {
+		return nil
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].taken.After(snapshots[j].taken) })
+	for _, old := range snapshots[keep:] {
+		if err := os.Remove(filepath.Join(dir, old.name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// rlockAll read-locks every collection on disk, in name order, and returns
+// a func that releases them.
+func (d *Driver) rlockAll() (func(), error) {
+	collections, err := d.Collections()
+	if err != nil {
+		return nil, err
+	}
+
+	locks := make([]*collectionLock, len(collections))
+	for i, collection := range collections {
+		locks[i] = d.getOrCreateMutex(collection)
+		locks[i].RLock()
+	}
+
+	return func() {
+		for _, lock := range locks {
+			lock.RUnlock()
+		}
+	}, nil
+}
+
+func isArchive(path string) bool {
+	return strings.HasSuffix(path, ".tar.gz") || strings.HasSuffix(path, ".tgz")
+}
+
+// walkBackup calls fn for every directory and file that belongs in a
+// backup, with its path relative to the database root.
+func (d *Driver) walkBackup(fn func(path, rel string, entry fs.DirEntry) error) error {
+	return d.walk(d.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(d.dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		if !entry.IsDir() && (!entry.Type().IsRegular() || strings.HasSuffix(entry.Name(), ".tmp")) {
+			return nil
+		}
+		return fn(path, rel, entry)
+	})
+}
+
+// copyTree mirrors the database into dest, which must not already contain
+// anything.
+func (d *Driver) copyTree(dest string) error {
+	if files, err := os.ReadDir(dest); err == nil && len(files) > 0 {
+		return fmt.Errorf("%w: backup destination %v is not empty", ErrExists, dest)
+	}
+
+	if err := os.MkdirAll(dest, d.dirPerm); err != nil {
+		return err
+	}
+
+	return d.walkBackup(func(path, rel string, entry fs.DirEntry) error {
+		target := filepath.Join(dest, rel)
+		if entry.IsDir() {
+			return os.MkdirAll(target, d.configAt(rel).dirPerm)
+		}
+
+		fi, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		b, err := d.fs.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, b, fi.Mode().Perm())
+	})
+}
+
+// archive writes the database as a gzipped tarball at dest.
+func (d *Driver) archive(dest string) error {
+	tmpPath := dest + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, d.filePerm)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+
+	err = d.walkBackup(func(path, rel string, entry fs.DirEntry) error {
+		fi, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if entry.IsDir() {
+			hdr.Name += "/"
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		b, err := d.fs.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		_, err = tw.Write(b)
+		return err
+	})
+
+	for _, closer := range []io.Closer{tw, zw, f} {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, dest)
+}
+
+// RestoreFromArchive replaces the database's contents with a snapshot made
+// by Backup, either a ".tar.gz"/".tgz" archive or a directory. It refuses
+// to touch a database that already holds data unless overwrite is set, in
+// which case everything currently in the database is removed first.
+//
+// The snapshot is unpacked next to the database and every record in it is
+// decoded before anything is swapped in, so a corrupt snapshot leaves the
+// database untouched.
+func (d *Driver) RestoreFromArchive(archivePath string, overwrite bool) error {
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+
+	unlock, err := d.lockAll()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	existing, err := d.fs.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 && !overwrite {
+		return fmt.Errorf("%w: database %v is not empty", ErrExists, d.dir)
+	}
+
+	root, err := filepath.Abs(d.dir)
+	if err != nil {
+		return err
+	}
+	stage := filepath.Join(filepath.Dir(root), "."+filepath.Base(root)+"-restore")
+	if err := d.fs.RemoveAll(stage); err != nil {
+		return err
+	}
+	if err := d.fs.MkdirAll(stage, d.dirPerm); err != nil {
+		return err
+	}
+	defer d.fs.RemoveAll(stage)
+
+	if isArchive(archivePath) {
+		err = d.unpackArchive(archivePath, stage)
+	} else {
+		err = d.unpackTree(archivePath, stage)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to restore from %v: %w", archivePath, err)
+	}
+
+	d.dirMu.Lock()
+	defer d.dirMu.Unlock()
+
+	for _, entry := range existing {
+		if err := d.fs.RemoveAll(filepath.Join(d.dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	restored, err := d.fs.ReadDir(stage)
+	if err != nil {
+		return err
+	}
+	for _, entry := range restored {
+		if err := d.fs.Rename(filepath.Join(stage, entry.Name()), filepath.Join(d.dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	if d.cache != nil {
+		d.cache.removePrefix("")
+	}
+
+	d.indexMu.Lock()
+	d.indexes = make(map[string]*collectionIndexes)
+	d.indexMu.Unlock()
+	return nil
+}
+
+// WithGlobalLock runs fn while holding the write lock of every collection on
+// disk, so no other caller can read or write them until fn returns. The
+// locks are taken in name order, the same order Backup uses, so the two
+// can't deadlock. Collections created while fn runs are not covered.
+//
+// fn must not call Driver methods that lock a collection, or it will
+// deadlock; it is meant for work done on the files directly.
+func (d *Driver) WithGlobalLock(fn func() error) error {
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+
+	unlock, err := d.lockAll()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return fn()
+}
+
+// lockAll write-locks every collection on disk, in name order, and returns
+// a func that releases them.
+func (d *Driver) lockAll() (func(), error) {
+	collections, err := d.Collections()
+	if err != nil {
+		return nil, err
+	}
+
+	locks := make([]*collectionLock, len(collections))
+	for i, collection := range collections {
+		locks[i] = d.getOrCreateMutex(collection)
+		locks[i].Lock()
+	}
+
+	return func() {
+		for _, lock := range locks {
+			lock.Unlock()
+		}
+	}, nil
+}
+
+func (d *Driver) unpackArchive(archivePath, stage string) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = d.restoreEntry(stage, hdr.Name, true, nil)
+		case tar.TypeReg:
+			err = d.restoreEntry(stage, hdr.Name, false, tr)
+		default:
+			err = fmt.Errorf("unexpected entry %v in archive", hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (d *Driver) unpackTree(src, stage string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		if entry.IsDir() {
+			return d.restoreEntry(stage, rel, true, nil)
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return d.restoreEntry(stage, rel, false, f)
+	})
+}
+
+// restoreEntry unpacks one snapshot entry into stage, checking that it
+// stays inside stage and, for records, that it decodes.
+func (d *Driver) restoreEntry(stage, name string, dir bool, r io.Reader) error {
+	rel := filepath.FromSlash(strings.TrimSuffix(name, "/"))
+	if !filepath.IsLocal(rel) {
+		return fmt.Errorf("%w: snapshot entry %q", ErrInvalidName, name)
+	}
+	target := filepath.Join(stage, rel)
+
+	if dir {
+		return d.fs.MkdirAll(target, d.configAt(rel).dirPerm)
+	}
+
+	cfg := d.configAt(filepath.Dir(rel))
+	if err := d.fs.MkdirAll(filepath.Dir(target), cfg.dirPerm); err != nil {
+		return err
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if err := d.fs.WriteFile(target, data, cfg.filePerm, false); err != nil {
+		return err
+	}
+
+	if _, ok := d.resourceName(filepath.Base(target)); !ok {
+		return nil
+	}
+
+	b, err := d.readRecord(target)
+	if err != nil {
+		return fmt.Errorf("invalid record %v: %w", name, err)
+	}
+	var v interface{}
+	if err := cfg.codec.Unmarshal(b, &v); err != nil {
+		return fmt.Errorf("invalid record %v: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// seedBackup writes two collections to d along with a temp file left by an
+// interrupted write, which no backup should include.
+func seedBackup(t *testing.T, d *Driver) {
+	t.Helper()
+
+	for _, name := range []string{"john", "mary"} {
+		if err := d.Write("users", name, User{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Write("orders", "1", User{Name: "order"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(d.dir, "users", "half.json.tmp"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackupDirectory(t *testing.T) {
+	d := newTestDriver(t, nil)
+	seedBackup(t, d)
+
+	dest := filepath.Join(t.TempDir(), "backup")
+	if err := d.Backup(dest); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "orders/1.json,users/john.json,users/mary.json"
+	if got := strings.Join(files(t, dest), ","); got != want {
+		t.Errorf("backup holds %v, want %v", got, want)
+	}
+
+	copied, err := New(dest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copied.Close()
+	var john User
+	if err := copied.Read("users", "john", &john); err != nil || john.Name != "john" {
+		t.Errorf("Read from the backup = %+v, %v", john, err)
+	}
+
+	if err := d.Backup(dest); !errors.Is(err, ErrExists) {
+		t.Errorf("Backup to a non-empty directory = %v, want ErrExists", err)
+	}
+}
+
+func TestBackupArchive(t *testing.T) {
+	d := newTestDriver(t, nil)
+	seedBackup(t, d)
+
+	dest := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := d.Backup(dest); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(zr)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			names = append(names, hdr.Name)
+		}
+	}
+
+	want := "orders/1.json,users/john.json,users/mary.json"
+	if got := strings.Join(names, ","); got != want {
+		t.Errorf("archive holds %v, want %v", got, want)
+	}
+	if _, err := os.Stat(dest + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("archive staging file left behind: %v", err)
+	}
+}
+
+func TestBackupInsideDatabase(t *testing.T) {
+	d := newTestDriver(t, nil)
+	seedBackup(t, d)
+
+	if err := d.Backup(filepath.Join(d.dir, "backup")); err == nil {
+		t.Error("Backup into the database itself succeeded, want an error")
+	}
+}
+
+func TestRestoreRoundTrip(t *testing.T) {
+	for _, name := range []string{"backup", "backup.tar.gz"} {
+		t.Run(name, func(t *testing.T) {
+			d := newTestDriver(t, nil)
+			seedBackup(t, d)
+
+			dest := filepath.Join(t.TempDir(), name)
+			if err := d.Backup(dest); err != nil {
+				t.Fatal(err)
+			}
+
+			// change the database after the snapshot
+			if err := d.Write("users", "late", User{Name: "late"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.Delete("users", "mary"); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := d.RestoreFromArchive(dest, false); !errors.Is(err, ErrExists) {
+				t.Fatalf("RestoreFromArchive without overwrite = %v, want ErrExists", err)
+			}
+			if err := d.RestoreFromArchive(dest, true); err != nil {
+				t.Fatal(err)
+			}
+
+			want := "orders/1.json,users/john.json,users/mary.json"
+			if got := strings.Join(files(t, d.dir), ","); got != want {
+				t.Errorf("restored database holds %v, want %v", got, want)
+			}
+			var mary User
+			if err := d.Read("users", "mary", &mary); err != nil || mary.Name != "mary" {
+				t.Errorf("Read(mary) after restore = %+v, %v", mary, err)
+			}
+		})
+	}
+}
+
+func TestRestoreCorruptSnapshot(t *testing.T) {
+	d := newTestDriver(t, nil)
+	seedBackup(t, d)
+
+	snapshot := filepath.Join(t.TempDir(), "snapshot")
+	if err := os.MkdirAll(filepath.Join(snapshot, "users"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(snapshot, "users", "bad.json"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	before := strings.Join(files(t, d.dir), ",")
+	if err := d.RestoreFromArchive(snapshot, true); err == nil {
+		t.Fatal("RestoreFromArchive of a corrupt snapshot succeeded")
+	}
+	if after := strings.Join(files(t, d.dir), ","); after != before {
+		t.Errorf("database holds %v after a failed restore, want %v untouched", after, before)
+	}
+	if leftovers := files(t, filepath.Dir(d.dir)); len(leftovers) != len(files(t, d.dir)) {
+		t.Errorf("restore staging left behind beside the database: %v", leftovers)
+	}
+}
+
+func TestCollectionDirPermInTrashAndBackups(t *testing.T) {
+	d := newTestDriver(t, &Options{SoftDelete: true})
+	if err := d.ConfigureCollection("secret", CollectionOptions{DirPerm: 0700}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if err := d.Write("secret", name, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Delete("secret", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	perm := func(path string) os.FileMode {
+		t.Helper()
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Mode().Perm()
+	}
+
+	dest := filepath.Join(t.TempDir(), "backup")
+	if err := d.Backup(dest); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RestoreFromArchive(dest, true); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{
+		filepath.Join(d.dir, trashDir, "secret"),
+		filepath.Join(dest, "secret"),
+		filepath.Join(dest, trashDir, "secret"),
+		filepath.Join(d.dir, "secret"),
+	} {
+		if got := perm(dir); got != 0700 {
+			t.Errorf("mode of %v = %v, want the collection's 0700", dir, got)
+		}
+	}
+
+	if err := d.Restore("secret", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DropCollection("secret"); err != nil {
+		t.Fatal(err)
+	}
+	if got := perm(filepath.Join(d.dir, trashDir, "secret")); got != 0700 {
+		t.Errorf("mode of the dropped collection in the trash = %v, want 0700", got)
+	}
+}
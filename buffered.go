@@ -0,0 +1,238 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bufferedStorage holds written files in memory and passes them on to the
+// storage underneath in batches, when Flush is called or once limit bytes
+// are waiting. Reads see buffered files as if they had been written.
+// Removals are not buffered, and a rename of anything but a buffered file
+// flushes first so the storage underneath sees changes in order.
+type bufferedStorage struct {
+	Storage
+
+	mu      sync.Mutex
+	pending map[string]*pendingFile
+	size    int
+	limit   int
+}
+
+type pendingFile struct {
+	data    []byte
+	perm    fs.FileMode
+	sync    bool
+	modTime time.Time
+}
+
+func newBufferedStorage(s Storage, limit int) *bufferedStorage {
+	return &bufferedStorage{Storage: s, pending: make(map[string]*pendingFile), limit: limit}
+}
+
+func (b *bufferedStorage) info(path string, f *pendingFile) fs.FileInfo {
+	return memInfo{name: filepath.Base(path), size: int64(len(f.data)), mode: f.perm.Perm(), modTime: f.modTime}
+}
+
+func (b *bufferedStorage) Stat(path string) (fs.FileInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if f, ok := b.pending[filepath.Clean(path)]; ok {
+		return b.info(path, f), nil
+	}
+	return b.Storage.Stat(path)
+}
+
+func (b *bufferedStorage) ReadFile(path string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if f, ok := b.pending[filepath.Clean(path)]; ok {
+		return append([]byte(nil), f.data...), nil
+	}
+	return b.Storage.ReadFile(path)
+}
+
+// ReadDir lists the directory underneath with the buffered files in it
+// added, or standing in for the files they will replace.
+func (b *bufferedStorage) ReadDir(path string) ([]fs.DirEntry, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entries, err := b.Storage.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Clean(path)
+	byName := make(map[string]int, len(entries))
+	for i, entry := range entries {
+		byName[entry.Name()] = i
+	}
+	added := false
+	for p, f := range b.pending {
+		if filepath.Dir(p) != dir {
+			continue
+		}
+		entry := fs.FileInfoToDirEntry(b.info(p, f))
+		if i, ok := byName[entry.Name()]; ok {
+			entries[i] = entry
+		} else {
+			entries = append(entries, entry)
+			added = true
+		}
+	}
+	if added {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	}
+	return entries, nil
+}
+
+// EvalSymlinks follows links in the storage underneath. Buffered files are
+// never links themselves, so only their directory is resolved.
+func (b *bufferedStorage) EvalSymlinks(path string) (string, error) {
+	r, ok := b.Storage.(resolver)
+	if !ok {
+		return path, nil
+	}
+
+	b.mu.Lock()
+	_, buffered := b.pending[filepath.Clean(path)]
+	b.mu.Unlock()
+
+	if !buffered {
+		return r.EvalSymlinks(path)
+	}
+	dir, err := r.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(path)), nil
+}
+
+func (b *bufferedStorage) WriteFile(path string, data []byte, perm fs.FileMode, sync bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// fail now rather than at flush time if the directory is missing
+	if fi, err := b.Storage.Stat(filepath.Dir(path)); err != nil {
+		return &fs.PathError{Op: "open", Path: path, Err: fs.ErrNotExist}
+	} else if !fi.IsDir() {
+		return &fs.PathError{Op: "open", Path: path, Err: fs.ErrInvalid}
+	}
+
+	path = filepath.Clean(path)
+	if old, ok := b.pending[path]; ok {
+		b.size -= len(old.data)
+	}
+	b.pending[path] = &pendingFile{data: append([]byte(nil), data...), perm: perm, sync: sync, modTime: time.Now()}
+	b.size += len(data)
+
+	if b.limit > 0 && b.size >= b.limit {
+		return b.flush()
+	}
+	return nil
+}
+
+func (b *bufferedStorage) Rename(oldpath, newpath string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	if f, ok := b.pending[oldpath]; ok {
+		if old, ok := b.pending[newpath]; ok {
+			b.size -= len(old.data)
+		}
+		delete(b.pending, oldpath)
+		b.pending[newpath] = f
+		return nil
+	}
+
+	if err := b.flush(); err != nil {
+		return err
+	}
+	return b.Storage.Rename(oldpath, newpath)
+}
+
+func (b *bufferedStorage) Remove(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	buffered := b.drop(path)
+	if err := b.Storage.Remove(path); err != nil && !(buffered && os.IsNotExist(err)) {
+		return err
+	}
+	return nil
+}
+
+func (b *bufferedStorage) RemoveAll(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.drop(path)
+	return b.Storage.RemoveAll(path)
+}
+
+// drop forgets the buffered files at or below path and reports whether path
+// itself was one. The caller must hold b.mu.
+func (b *bufferedStorage) drop(path string) bool {
+	path = filepath.Clean(path)
+	_, buffered := b.pending[path]
+	for p, f := range b.pending {
+		if p == path || strings.HasPrefix(p, path+string(filepath.Separator)) {
+			b.size -= len(f.data)
+			delete(b.pending, p)
+		}
+	}
+	return buffered
+}
+
+// Flush writes every buffered file to the storage underneath.
+func (b *bufferedStorage) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.flush()
+}
+
+// flush writes the buffered files in name order, each staged and renamed
+// into place like any other write. Files it couldn't write stay buffered.
+// The caller must hold b.mu.
+func (b *bufferedStorage) flush() error {
+	paths := make([]string, 0, len(b.pending))
+	for path := range b.pending {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	synced := make(map[string]bool)
+	for _, path := range paths {
+		f := b.pending[path]
+		if err := b.Storage.WriteFile(path+".tmp", f.data, f.perm, f.sync); err != nil {
+			b.Storage.Remove(path + ".tmp")
+			return err
+		}
+		if err := b.Storage.Rename(path+".tmp", path); err != nil {
+			return err
+		}
+
+		b.size -= len(f.data)
+		delete(b.pending, path)
+		if f.sync {
+			synced[filepath.Dir(path)] = true
+		}
+	}
+
+	for dir := range synced {
+		if err := b.Storage.SyncDir(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
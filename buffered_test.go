@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBufferedWritesFlushOnClose(t *testing.T) {
+	d := newTestDriver(t, &Options{FlushInterval: time.Hour})
+	path := filepath.Join(d.dir, "users", "john.json")
+
+	if err := d.Write("users", "john", "john"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Stat before a flush = %v, want the write still buffered", err)
+	}
+	var v string
+	if err := d.Read("users", "john", &v); err != nil || v != "john" {
+		t.Errorf("Read of a buffered write = %q, %v", v, err)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Stat after Close = %v, want the buffer written out", err)
+	}
+
+	reopened, err := New(d.dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if err := reopened.Read("users", "john", &v); err != nil || v != "john" {
+		t.Errorf("Read after reopening = %q, %v", v, err)
+	}
+}
+
+func TestBufferedWritesFlushSize(t *testing.T) {
+	d := newTestDriver(t, &Options{FlushSize: 64})
+
+	if err := d.Write("users", "small", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(d.dir, "users", "small.json")); !os.IsNotExist(err) {
+		t.Errorf("Stat under FlushSize = %v, want the write still buffered", err)
+	}
+
+	big := make([]byte, 100)
+	for i := range big {
+		big[i] = 'x'
+	}
+	if err := d.Write("users", "big", string(big)); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"small.json", "big.json"} {
+		if _, err := os.Stat(filepath.Join(d.dir, "users", name)); err != nil {
+			t.Errorf("Stat(%v) past FlushSize = %v, want the buffer written out", name, err)
+		}
+	}
+}
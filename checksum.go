@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// sumMagic starts every checksummed record. No codec output, gzip stream or
+// sealed record plausibly begins with it, so records written with and
+// without checksums can sit side by side.
+var sumMagic = []byte("\x00gdbsum\x00")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// addChecksum wraps b in an envelope holding its CRC-32C.
+func addChecksum(b []byte) []byte {
+	out := make([]byte, 0, len(sumMagic)+4+len(b))
+	out = append(out, sumMagic...)
+	out = binary.BigEndian.AppendUint32(out, crc32.Checksum(b, crcTable))
+	return append(out, b...)
+}
+
+// checkChecksum verifies and strips a checksum envelope. Data without one is
+// returned as is.
+func checkChecksum(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, sumMagic) {
+		return b, nil
+	}
+
+	b = b[len(sumMagic):]
+	if len(b) < 4 {
+		return nil, ErrChecksumMismatch
+	}
+	sum, b := binary.BigEndian.Uint32(b), b[4:]
+	if crc32.Checksum(b, crcTable) != sum {
+		return nil, ErrChecksumMismatch
+	}
+	return b, nil
+}
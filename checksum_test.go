@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChecksumDetectsDamage(t *testing.T) {
+	for _, opts := range []Options{{Checksum: true}, {Checksum: true, Compress: true}} {
+		d := newTestDriver(t, &opts)
+		if err := d.Write("users", "john", User{Name: "John"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Write("users", "mary", User{Name: "Mary"}); err != nil {
+			t.Fatal(err)
+		}
+
+		path, err := d.findRecord("users", "john")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(b, sumMagic) {
+			t.Fatalf("record %q carries no checksum", b)
+		}
+		b[len(b)-2] ^= 0xff
+		if err := os.WriteFile(path, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var john User
+		if err := d.Read("users", "john", &john); !errors.Is(err, ErrChecksumMismatch) {
+			t.Errorf("Read of a damaged record = %v, want ErrChecksumMismatch", err)
+		}
+		if _, err := d.ReadAll("users"); !errors.Is(err, ErrChecksumMismatch) {
+			t.Errorf("ReadAll over a damaged record = %v, want ErrChecksumMismatch", err)
+		}
+		records, problems, err := d.ReadAllLenient("users")
+		if err != nil || len(records) != 1 || len(problems) != 1 || !errors.Is(problems[0], ErrChecksumMismatch) {
+			t.Errorf("ReadAllLenient = %v, %v, %v, want mary and one checksum mismatch", records, problems, err)
+		}
+	}
+}
+
+func TestChecksumTurnedOnLater(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+	plain, err := New(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.Write("users", "john", User{Name: "John"}); err != nil {
+		t.Fatal(err)
+	}
+	plain.Close()
+
+	d, err := New(dir, &Options{Checksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	var john User
+	if err := d.Read("users", "john", &john); err != nil || john.Name != "John" {
+		t.Errorf("Read of a record written without checksums = %+v, %v", john, err)
+	}
+	if err := d.Write("users", "mary", User{Name: "Mary"}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "users", "mary.json"))
+	if err != nil || !bytes.HasPrefix(b, sumMagic) {
+		t.Errorf("record written with Checksum = %q, %v, want a checksum", b, err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import "sync"
+
+// shared is the state a driver has in common with the drivers derived from
+// it by WithOptions: everything that has to agree between drivers working
+// on the same files.
+type shared struct {
+	mutex   sync.Mutex
+	mutexes map[string]*collectionLock
+	dirMu   sync.Mutex
+
+	watchMu  sync.Mutex
+	watchers map[string]map[chan Event]struct{}
+
+	cache *cache
+
+	indexMu sync.Mutex
+	indexes map[string]*collectionIndexes
+}
+
+func newShared() *shared {
+	return &shared{
+		mutexes:  make(map[string]*collectionLock),
+		watchers: make(map[string]map[chan Event]struct{}),
+		indexes:  make(map[string]*collectionIndexes),
+	}
+}
+
+// WithOptions returns a new driver over the same database, set up with
+// opts instead of the options d was opened with, such as one with Sync set
+// for writes that must not be lost.
+//
+// Two drivers opened separately with New on one directory each have their
+// own locks and would race on the files. A derived driver instead shares
+// d's locks, so the two take turns exactly as two callers of one driver
+// do, along with everything else kept in memory about the files: the
+// cache, the loaded indexes and the watchers, so a Watch on either sees
+// writes made through both. For the same reason it keeps d's storage and
+// write buffer, and the Storage, InMemory, FlushInterval, FlushSize and
+// CacheSize fields of opts are ignored. Ext defaults to d's rather than the
+// codec's, so the records are found; an EncryptionKey other than d's can't
+// read them.
+//
+// Schemas, registered types and collection options set on d so far are
+// copied, and can be changed on either driver afterwards without affecting
+// the other. Closing the derived driver leaves d and its watchers alone;
+// close derived drivers before d, since writes buffered through them are
+// only flushed while d is open.
+func (d *Driver) WithOptions(opts Options) (*Driver, error) {
+	if err := d.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	opts.Storage = d.fs
+	opts.InMemory = false
+	opts.FlushInterval, opts.FlushSize = 0, 0
+	opts.CacheSize = 0
+	if opts.Ext == "" {
+		opts.Ext = d.ext
+	}
+
+	derived, err := open(d.dir, &opts, d.shared)
+	if err != nil {
+		return nil, err
+	}
+	derived.derived = true
+	derived.buffer = d.buffer
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for collection, schema := range d.schemas {
+		derived.schemas[collection] = schema
+	}
+	for collection, check := range d.types {
+		derived.types[collection] = check
+	}
+	for collection, cfg := range d.configs {
+		derived.configs[collection] = cfg
+	}
+	return derived, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Codec converts records to and from their on-disk form. Ext is the file
+// extension, including the leading dot, given to records it produces.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	Ext() string
+}
+
+// JSONCodec stores records as tab-indented JSON, or as a single line when
+// Compact is set. It is the default.
+type JSONCodec struct {
+	Compact bool
+
+	// DisableHTMLEscape writes <, > and & as they are rather than as
+	// \u003c-style escapes.
+	DisableHTMLEscape bool
+
+	// UseNumber decodes numbers into interface{} values as json.Number
+	// instead of float64, so large integers survive a round trip.
+	UseNumber bool
+}
+
+func (c JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(!c.DisableHTMLEscape)
+	if !c.Compact {
+		enc.SetIndent("", "\t")
+	}
+	// Encode ends the record with a newline
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	if !c.UseNumber {
+		return json.Unmarshal(data, v)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("invalid character after top-level value")
+	}
+	return nil
+}
+
+func (JSONCodec) Ext() string { return ".json" }
+
+// YAMLCodec stores records as YAML, which is friendlier to edit by hand.
+type YAMLCodec struct{}
+
+func (YAMLCodec) Marshal(v interface{}) ([]byte, error) {
+	return yaml.Marshal(v)
+}
+
+func (YAMLCodec) Unmarshal(data []byte, v interface{}) error {
+	return yaml.Unmarshal(data, v)
+}
+
+func (YAMLCodec) Ext() string { return ".yaml" }
+
+// GobCodec stores records in Go's binary gob format.
+type GobCodec struct{}
+
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (GobCodec) Ext() string { return ".gob" }
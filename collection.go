@@ -0,0 +1,38 @@
+package main
+
+// Collection is a handle on one collection, so its name needn't be passed
+// to every call. It holds nothing but the name; every method is the Driver
+// method of the same name.
+type Collection struct {
+	d    *Driver
+	name string
+}
+
+// Collection returns a handle on a collection. The name is checked by each
+// call, not here.
+func (d *Driver) Collection(name string) *Collection {
+	return &Collection{d: d, name: name}
+}
+
+// Name returns the collection's name.
+func (c *Collection) Name() string {
+	return c.name
+}
+
+func (c *Collection) Write(resource string, v interface{}) error {
+	return c.d.Write(c.name, resource, v)
+}
+
+func (c *Collection) Read(resource string, v interface{}) error {
+	return c.d.Read(c.name, resource, v)
+}
+
+func (c *Collection) ReadAll() ([]string, error) {
+	return c.d.ReadAll(c.name)
+}
+
+// Delete removes a record. An empty resource fails with ErrMissingResource;
+// use Driver.DropCollection to remove the whole collection.
+func (c *Collection) Delete(resource string) error {
+	return c.d.Delete(c.name, resource)
+}
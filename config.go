@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CollectionOptions override some of the database's Options for a single
+// collection. Fields left at their zero value fall back to the database's
+// settings.
+type CollectionOptions struct {
+	// Codec encodes the collection's records in place of Options.Codec.
+	// Records keep the database's Ext, so they are listed like any other.
+	Codec Codec
+
+	// Compress, when set, overrides Options.Compress.
+	Compress *bool
+
+	// Compact, when set, overrides Options.Compact. It only affects the
+	// JSON codec.
+	Compact *bool
+
+	// DirPerm and FilePerm override the modes of the collection's
+	// directory and files.
+	DirPerm  os.FileMode
+	FilePerm os.FileMode
+
+	// AppendOnly makes the collection a log: new records can be written
+	// and read, but writing over an existing one, giving it an expiry,
+	// renaming, moving or deleting it fails with ErrReadOnly, as does
+	// deleting, truncating or replacing the collection or one it is nested
+	// in. Together with Insert's numeric IDs this makes an immutable event
+	// log.
+	AppendOnly bool
+}
+
+// collectionConfig is the settings a collection's records are written and
+// read with.
+type collectionConfig struct {
+	codec      Codec
+	compress   bool
+	dirPerm    os.FileMode
+	filePerm   os.FileMode
+	appendOnly bool
+}
+
+// ConfigureCollection sets the options a collection's records are written
+// and read with, replacing any set before; the zero CollectionOptions puts
+// the collection back on the database's settings. It applies to the named
+// collection only, not to collections nested in it.
+//
+// Records already on disk are not rewritten. A change of Compress is
+// harmless, as records are decompressed by extension, but after a change of
+// Codec the records written before it can no longer be decoded, so pick the
+// codec before the collection is first written to.
+func (d *Driver) ConfigureCollection(collection string, opts CollectionOptions) error {
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+
+	if collection == "" {
+		return fmt.Errorf("%w - unable to configure collection!", ErrMissingCollection)
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	cfg := collectionConfig{codec: d.codec, compress: d.compress, dirPerm: d.dirPerm, filePerm: d.filePerm}
+	if opts.Codec != nil {
+		cfg.codec = opts.Codec
+	}
+	if opts.Compact != nil {
+		if c, ok := cfg.codec.(JSONCodec); ok {
+			c.Compact = *opts.Compact
+			cfg.codec = c
+		}
+	}
+	if opts.Compress != nil {
+		cfg.compress = *opts.Compress
+	}
+	if opts.DirPerm != 0 {
+		cfg.dirPerm = opts.DirPerm
+	}
+	if opts.FilePerm != 0 {
+		cfg.filePerm = opts.FilePerm
+	}
+	cfg.appendOnly = opts.AppendOnly
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if opts.Codec == nil && opts.Compress == nil && opts.Compact == nil && opts.DirPerm == 0 && opts.FilePerm == 0 && !opts.AppendOnly {
+		delete(d.configs, collection)
+		return nil
+	}
+	d.configs[collection] = cfg
+	return nil
+}
+
+// config returns the settings for a collection's records.
+func (d *Driver) config(collection string) collectionConfig {
+	// this may be the first use of a Driver made without New
+	d.defaults()
+
+	d.mutex.Lock()
+	cfg, ok := d.configs[collection]
+	d.mutex.Unlock()
+	if ok {
+		return cfg
+	}
+	return collectionConfig{codec: d.codec, compress: d.compress, dirPerm: d.dirPerm, filePerm: d.filePerm}
+}
+
+// configAt returns the settings for dir, a directory given relative to the
+// database root: those of the collection it belongs to, which for the
+// trash and for dot directories such as indexes is the collection they sit
+// under, or the database's own for the root.
+func (d *Driver) configAt(dir string) collectionConfig {
+	parts := strings.Split(filepath.ToSlash(filepath.Clean(dir)), "/")
+	if parts[0] == trashDir {
+		parts = parts[1:]
+	}
+	for i, part := range parts {
+		if strings.HasPrefix(part, ".") {
+			parts = parts[:i]
+			break
+		}
+	}
+	return d.config(strings.Join(parts, "/"))
+}
+
+// checkOverwrite fails with ErrReadOnly if resource already exists in an
+// append-only collection. The caller must hold the record's lock.
+func (d *Driver) checkOverwrite(collection, resource string) error {
+	if !d.config(collection).appendOnly {
+		return nil
+	}
+
+	_, err := d.findRecord(collection, resource)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: %v/%v exists and %v is append-only", ErrReadOnly, collection, resource, collection)
+}
+
+// checkDelete fails with ErrReadOnly if records can't be removed from
+// collection because it is append-only, or, with nested set, because a
+// collection nested in it is.
+func (d *Driver) checkDelete(collection string, nested bool) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for name, cfg := range d.configs {
+		if !cfg.appendOnly {
+			continue
+		}
+		if name == collection || nested && strings.HasPrefix(name, collection+"/") {
+			return fmt.Errorf("%w: %v is append-only", ErrReadOnly, name)
+		}
+	}
+	return nil
+}
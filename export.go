@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Redaction scrubs fields from the records ExportNDJSON and ExportCSV
+// write. The stored records are left as they are.
+type Redaction struct {
+	// Fields are the fields to scrub. A field may reach into nested
+	// objects with dots, as in "Address.Pincode"; fields a record lacks
+	// are skipped.
+	Fields []string
+
+	// Hash replaces each value with the hex SHA-256 of its JSON instead of
+	// null, so equal values still match across records and exports.
+	Hash bool
+
+	// Key, when set, makes the hash an HMAC-SHA256 keyed with it. Without
+	// one, a value with few possibilities, such as a pincode, can be
+	// recovered by hashing every candidate.
+	Key []byte
+}
+
+// ExportNDJSON writes every record in a collection to w, in name order, as
+// newline-delimited JSON: one compact JSON document per line. Records are
+// streamed one at a time under the collection's read lock. Resource names
+// are left out, so the lines are the records themselves, ready for
+// ImportNDJSON to name again with its key; use ExportNDJSONNamed to keep
+// them. Fields named in redact are scrubbed from the records' objects.
+func (d *Driver) ExportNDJSON(collection string, w io.Writer, redact ...Redaction) error {
+	return d.exportNDJSON(collection, w, false, redact)
+}
+
+// ExportNDJSONNamed is ExportNDJSON but wraps each record with its resource
+// name, writing lines of the form {"resource":"john","record":{...}}.
+func (d *Driver) ExportNDJSONNamed(collection string, w io.Writer, redact ...Redaction) error {
+	return d.exportNDJSON(collection, w, true, redact)
+}
+
+// exportNDJSON writes one line per record, wrapped with its name when named
+// is set.
+func (d *Driver) exportNDJSON(collection string, w io.Writer, named bool, redact []Redaction) error {
+	var line bytes.Buffer
+	return d.each(context.Background(), collection, func(resource string, raw []byte) error {
+		b, err := d.toJSON(collection, raw)
+		if err != nil {
+			return fmt.Errorf("unable to convert %s to JSON: %w", resource, err)
+		}
+
+		if len(redact) > 0 {
+			if b, err = redactJSON(b, redact); err != nil {
+				return fmt.Errorf("unable to redact %s: %w", resource, err)
+			}
+		}
+
+		line.Reset()
+		if named {
+			name, err := json.Marshal(resource)
+			if err != nil {
+				return err
+			}
+			line.WriteString(`{"resource":`)
+			line.Write(name)
+			line.WriteString(`,"record":`)
+		}
+		if err := json.Compact(&line, b); err != nil {
+			return fmt.Errorf("unable to convert %s to JSON: %w", resource, err)
+		}
+		if named {
+			line.WriteByte('}')
+		}
+		line.WriteByte('\n')
+		_, err = w.Write(line.Bytes())
+		return err
+	}, nil)
+}
+
+// ImportNDJSON reads newline-delimited JSON from r and writes each line as a
+// record in a collection, naming it with key, which is given the line's raw
+// JSON. Blank lines are ignored. It stops at the first line that is not
+// valid JSON or can't be named, and returns how many records it wrote.
+func (d *Driver) ImportNDJSON(collection string, r io.Reader, key func(raw []byte) (string, error)) (int, error) {
+	return d.importNDJSON(collection, r, key, nil)
+}
+
+// ImportNDJSONLenient is ImportNDJSON but skips the lines it can't import,
+// logging them and returning one error per skipped line alongside the count.
+// The error result is only set when reading r or writing a record fails.
+func (d *Driver) ImportNDJSONLenient(collection string, r io.Reader, key func(raw []byte) (string, error)) (int, []error, error) {
+	var problems []error
+	n, err := d.importNDJSON(collection, r, key, func(line int, err error) {
+		d.logger().Warn("Skipping line %d of import into %v: %v\n", line, collection, err)
+		problems = append(problems, fmt.Errorf("line %d: %w", line, err))
+	})
+	return n, problems, err
+}
+
+// importNDJSON writes each record read from r. A line that can't be decoded
+// or named is passed to bad and skipped, or stops the import when bad is
+// nil.
+func (d *Driver) importNDJSON(collection string, r io.Reader, key func(raw []byte) (string, error), bad func(line int, err error)) (int, error) {
+	if err := d.checkOpen(); err != nil {
+		return 0, err
+	}
+
+	if collection == "" {
+		return 0, fmt.Errorf("%w - unable to import!", ErrMissingCollection)
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return 0, err
+	}
+
+	// bufio.Reader rather than Scanner, so long records aren't cut off
+	br := bufio.NewReader(r)
+	n := 0
+	for line := 1; ; line++ {
+		raw, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		eof := err == io.EOF
+
+		if raw = bytes.TrimSpace(raw); len(raw) > 0 {
+			v, resource, lineErr := decodeLine(raw, key)
+			if lineErr != nil {
+				if bad == nil {
+					return n, fmt.Errorf("unable to import line %d: %w", line, lineErr)
+				}
+				bad(line, lineErr)
+			} else {
+				if err := d.Write(collection, resource, v); err != nil {
+					return n, fmt.Errorf("unable to import line %d: %w", line, err)
+				}
+				n++
+			}
+		}
+
+		if eof {
+			return n, nil
+		}
+	}
+}
+
+// decodeLine decodes one line of an import and names it, keeping numbers
+// exact rather than rounding them through float64.
+func decodeLine(raw []byte, key func(raw []byte) (string, error)) (interface{}, string, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, "", err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, "", errors.New("more than one JSON value")
+	}
+
+	resource, err := key(raw)
+	if err != nil {
+		return nil, "", err
+	}
+	if resource == "" {
+		return nil, "", fmt.Errorf("%w - key returned no name", ErrMissingResource)
+	}
+	if err := checkResource(resource); err != nil {
+		return nil, "", err
+	}
+	return v, resource, nil
+}
+
+// ExportCSV writes a collection to w as CSV: a header row of fields, then
+// one row per record in name order holding those fields' values. A field may
+// reach into nested objects with dots, as in "Address.City". Missing fields
+// become empty cells, and objects and arrays are written as JSON. Fields
+// named in redact are scrubbed first, so blanked ones are empty too.
+func (d *Driver) ExportCSV(collection string, fields []string, w io.Writer, redact ...Redaction) error {
+	paths := make([][]string, len(fields))
+	for i, field := range fields {
+		paths[i] = strings.Split(field, ".")
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(fields); err != nil {
+		return err
+	}
+
+	row := make([]string, len(fields))
+	err := d.each(context.Background(), collection, func(resource string, raw []byte) error {
+		record := map[string]interface{}{}
+		if err := d.decodeFields(collection, raw, &record); err != nil {
+			return fmt.Errorf("unable to decode %s: %w", resource, err)
+		}
+		if err := redactFields(record, redact); err != nil {
+			return fmt.Errorf("unable to redact %s: %w", resource, err)
+		}
+
+		for i, path := range paths {
+			v, _ := lookupField(record, path)
+			cell, err := csvCell(v)
+			if err != nil {
+				return fmt.Errorf("unable to export %s: %w", resource, err)
+			}
+			row[i] = cell
+		}
+		return cw.Write(row)
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// redactJSON scrubs the fields of a JSON record. Records that aren't
+// objects have no fields and are returned as they are.
+func redactJSON(b []byte, redact []Redaction) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	record, ok := v.(map[string]interface{})
+	if !ok {
+		return b, nil
+	}
+	if err := redactFields(record, redact); err != nil {
+		return nil, err
+	}
+	return json.Marshal(record)
+}
+
+// redactFields scrubs fields of a decoded record in place.
+func redactFields(record map[string]interface{}, redact []Redaction) error {
+	for _, r := range redact {
+		for _, field := range r.Fields {
+			path := strings.Split(field, ".")
+
+			parent := record
+			for _, key := range path[:len(path)-1] {
+				if parent, _ = parent[key].(map[string]interface{}); parent == nil {
+					break
+				}
+			}
+			last := path[len(path)-1]
+			if _, ok := parent[last]; !ok {
+				continue
+			}
+
+			if !r.Hash {
+				parent[last] = nil
+				continue
+			}
+
+			b, err := json.Marshal(parent[last])
+			if err != nil {
+				return err
+			}
+			var h hash.Hash
+			if r.Key != nil {
+				h = hmac.New(sha256.New, r.Key)
+			} else {
+				h = sha256.New()
+			}
+			h.Write(b)
+			parent[last] = hex.EncodeToString(h.Sum(nil))
+		}
+	}
+	return nil
+}
+
+// csvCell formats a field value for a CSV cell.
+func csvCell(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+
+	if n, ok := number(v); ok {
+		return strconv.FormatFloat(n, 'f', -1, 64), nil
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
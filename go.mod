@@ -2,4 +2,7 @@ module github.com/singh-vinayak/go-database
 
 go 1.22.5
 
-require github.com/jcelliott/lumber v0.0.0-20160324203708-dd349441af25
+require (
+	github.com/jcelliott/lumber v0.0.0-20160324203708-dd349441af25
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Handler serves the database over HTTP with JSON bodies:
+//
+//	GET    /{collection}            every record, as a JSON array
+//	GET    /{collection}/{resource} one record
+//	PUT    /{collection}/{resource} write a record (201 if new, 200 if replaced)
+//	DELETE /{collection}/{resource} delete a record (204)
+//
+// Missing or invalid names get 400 and missing records 404.
+func (d *Driver) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /{collection}", d.serveReadAll)
+	mux.HandleFunc("GET /{collection}/{resource}", d.serveRead)
+	mux.HandleFunc("PUT /{collection}/{resource}", d.serveWrite)
+	mux.HandleFunc("DELETE /{collection}/{resource}", d.serveDelete)
+
+	mux.HandleFunc("/{$}", func(w http.ResponseWriter, r *http.Request) {
+		d.httpError(w, fmt.Errorf("%w - no collection in path", ErrMissingCollection))
+	})
+	mux.HandleFunc("/{collection}/{$}", func(w http.ResponseWriter, r *http.Request) {
+		d.httpError(w, fmt.Errorf("%w - no resource in path", ErrMissingResource))
+	})
+
+	return mux
+}
+
+func (d *Driver) serveReadAll(w http.ResponseWriter, r *http.Request) {
+	collection := r.PathValue("collection")
+	records, err := d.ReadAllContext(r.Context(), collection)
+	if err != nil {
+		d.httpError(w, err)
+		return
+	}
+
+	body := make([]json.RawMessage, len(records))
+	for i, record := range records {
+		if body[i], err = d.toJSON(collection, []byte(record)); err != nil {
+			d.httpError(w, err)
+			return
+		}
+	}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		d.httpError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, b)
+}
+
+func (d *Driver) serveRead(w http.ResponseWriter, r *http.Request) {
+	collection := r.PathValue("collection")
+	raw, err := d.ReadRaw(collection, r.PathValue("resource"))
+	if err != nil {
+		d.httpError(w, err)
+		return
+	}
+
+	b, err := d.toJSON(collection, raw)
+	if err != nil {
+		d.httpError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, b)
+}
+
+func (d *Driver) serveWrite(w http.ResponseWriter, r *http.Request) {
+	// keep numbers exact rather than rounding them through float64
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		http.Error(w, fmt.Sprintf("invalid JSON body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		http.Error(w, "invalid JSON body: more than one value", http.StatusBadRequest)
+		return
+	}
+
+	created, err := d.Upsert(r.PathValue("collection"), r.PathValue("resource"), v)
+	if err != nil {
+		d.httpError(w, err)
+		return
+	}
+
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (d *Driver) serveDelete(w http.ResponseWriter, r *http.Request) {
+	if err := d.DeleteContext(r.Context(), r.PathValue("collection"), r.PathValue("resource")); err != nil {
+		d.httpError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// toJSON converts a record's codec output to JSON, passing JSON through
+// untouched.
+func (d *Driver) toJSON(collection string, raw []byte) (json.RawMessage, error) {
+	codec := d.config(collection).codec
+	if _, ok := codec.(JSONCodec); ok {
+		return bytes.TrimSpace(raw), nil
+	}
+
+	var v interface{}
+	if err := codec.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+func writeJSON(w http.ResponseWriter, status int, b []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+	w.Write([]byte("\n"))
+}
+
+// httpStatuses maps the errors clients can be told about to their status
+// codes, most specific first.
+var httpStatuses = []struct {
+	err    error
+	status int
+}{
+	{ErrResourceNotFound, http.StatusNotFound},
+	{ErrCollectionNotFound, http.StatusNotFound},
+	{ErrNotFound, http.StatusNotFound},
+	{ErrMissingCollection, http.StatusBadRequest},
+	{ErrMissingResource, http.StatusBadRequest},
+	{ErrInvalidName, http.StatusBadRequest},
+	{ErrVersionConflict, http.StatusConflict},
+	{ErrReadOnly, http.StatusConflict},
+	{ErrClosed, http.StatusServiceUnavailable},
+}
+
+// httpError replies with the status code that best describes err. The body
+// only names the kind of error, as err itself may hold file paths and other
+// details of the server; the whole of err is logged instead. Validation
+// errors are sent in full, as they only describe the client's own record.
+func (d *Driver) httpError(w http.ResponseWriter, err error) {
+	status, msg := http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
+
+	var invalid *ValidationError
+	if errors.As(err, &invalid) {
+		status, msg = http.StatusBadRequest, invalid.Error()
+	} else {
+		for _, s := range httpStatuses {
+			if errors.Is(err, s.err) {
+				status, msg = s.status, s.err.Error()
+				break
+			}
+		}
+	}
+
+	if status >= 500 {
+		d.logger().Error("HTTP %d: %v\n", status, err)
+	} else {
+		d.logger().Debug("HTTP %d: %v\n", status, err)
+	}
+	http.Error(w, msg, status)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandlerErrorsHidePaths(t *testing.T) {
+	d := newTestDriver(t, nil)
+	if err := d.Write("users", "john", User{Name: "john"}); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(d.Handler())
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/users/Nope", http.StatusNotFound, "resource not found"},
+		{"/nobody/john", http.StatusNotFound, "collection not found"},
+		{"/nobody", http.StatusNotFound, "collection not found"},
+		{"/users/john", http.StatusOK, ""},
+		{"/users/", http.StatusBadRequest, ErrMissingResource.Error()},
+	} {
+		resp, err := http.Get(srv.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != tc.status {
+			t.Errorf("GET %v = %d, want %d", tc.path, resp.StatusCode, tc.status)
+		}
+		if strings.Contains(string(b), d.Dir()) {
+			t.Errorf("GET %v body %q gives away the database path", tc.path, b)
+		}
+		if tc.body != "" && strings.TrimSpace(string(b)) != tc.body {
+			t.Errorf("GET %v body = %q, want %q", tc.path, b, tc.body)
+		}
+	}
+}
@@ -0,0 +1,710 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// indexDir holds a collection's indexes, one directory per field. Each
+// value of the field has a file of its own in there, named by a hash of its
+// key, so a change to one record only rewrites the files of the values it
+// leaves and takes.
+const indexDir = ".indexes"
+
+// index maps the key of a field value to the resources that hold it. Each
+// of an index's files holds one, for the keys that hash to its name.
+type index map[string][]string
+
+// fieldIndex is a field's index as kept in memory.
+type fieldIndex struct {
+	keys      index             // resources by key, in name order
+	resources map[string]string // and the reverse, so no scan finds a record's key
+}
+
+func newFieldIndex() *fieldIndex {
+	return &fieldIndex{keys: index{}, resources: make(map[string]string)}
+}
+
+// add records that resource holds key, replacing what it held before.
+func (fi *fieldIndex) add(key, resource string) {
+	if old, ok := fi.resources[resource]; ok {
+		fi.remove(old, resource)
+	}
+	resources := fi.keys[key]
+	i := sort.SearchStrings(resources, resource)
+	fi.keys[key] = append(resources[:i], append([]string{resource}, resources[i:]...)...)
+	fi.resources[resource] = key
+}
+
+// remove forgets that resource holds key.
+func (fi *fieldIndex) remove(key, resource string) {
+	resources := fi.keys[key]
+	if i := sort.SearchStrings(resources, resource); i < len(resources) && resources[i] == resource {
+		resources = append(resources[:i], resources[i+1:]...)
+	}
+	if len(resources) == 0 {
+		delete(fi.keys, key)
+	} else {
+		fi.keys[key] = resources
+	}
+	delete(fi.resources, resource)
+}
+
+// collectionIndexes are one collection's indexes. Each collection's are
+// guarded by a lock of their own, so keeping one collection's indexes up to
+// date never holds up writes to another; d.indexMu only guards the map they
+// are kept in.
+type collectionIndexes struct {
+	mu     sync.Mutex
+	fields map[string]*fieldIndex // nil until loaded from disk
+}
+
+// CreateIndex builds an index of field's values in a collection and keeps
+// it up to date on every later change, so FindBy can answer without
+// reading every record. field may reach into nested objects with dots, as
+// in "Address.City". Creating an index that exists rebuilds it.
+func (d *Driver) CreateIndex(collection, field string) error {
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+
+	if collection == "" {
+		return fmt.Errorf("%w - unable to create index!", ErrMissingCollection)
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	if err := checkIndexField(field); err != nil {
+		return err
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return d.buildIndex(collection, field)
+}
+
+// Indexes lists, in name order, the fields a collection has indexes on.
+func (d *Driver) Indexes(collection string) ([]string, error) {
+	if err := d.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	if collection == "" {
+		return nil, fmt.Errorf("%w - unable to list indexes!", ErrMissingCollection)
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return nil, err
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	return d.indexFiles(collection)
+}
+
+// DropIndex removes the index on field from a collection. FindBy goes back
+// to reading every record for that field.
+func (d *Driver) DropIndex(collection, field string) error {
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+
+	if collection == "" {
+		return fmt.Errorf("%w - unable to drop index!", ErrMissingCollection)
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	if err := checkIndexField(field); err != nil {
+		return err
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	path := filepath.Join(d.dir, collection, indexDir, field)
+	if _, err := d.fs.Stat(path); os.IsNotExist(err) {
+		return fmt.Errorf("%w: no index on %v of %v", ErrNotFound, field, collection)
+	}
+	if err := d.fs.RemoveAll(path); err != nil {
+		return err
+	}
+
+	ci := d.collectionIndexes(collection)
+	ci.mu.Lock()
+	delete(ci.fields, field)
+	ci.mu.Unlock()
+	return nil
+}
+
+// ReindexAll rebuilds every index of a collection from its records, for
+// when they have drifted, say after records were edited by hand.
+func (d *Driver) ReindexAll(collection string) error {
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+
+	if collection == "" {
+		return fmt.Errorf("%w - unable to rebuild indexes!", ErrMissingCollection)
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return d.rebuildIndexes(collection)
+}
+
+// rebuildIndexes rebuilds every index of a collection, even ones whose
+// files are too damaged to load. The caller must hold the collection's
+// write lock.
+func (d *Driver) rebuildIndexes(collection string) error {
+	fields, err := d.indexFiles(collection)
+	if err != nil {
+		return err
+	}
+
+	ci := d.collectionIndexes(collection)
+	ci.mu.Lock()
+	ci.fields = make(map[string]*fieldIndex)
+	ci.mu.Unlock()
+
+	for _, field := range fields {
+		if err := d.buildIndex(collection, field); err != nil {
+			return fmt.Errorf("unable to rebuild index %v of %v: %w", field, collection, err)
+		}
+	}
+	return nil
+}
+
+// indexFiles lists the fields a collection has indexes for. They are
+// listed from disk rather than loaded, so a damaged one is still found.
+func (d *Driver) indexFiles(collection string) ([]string, error) {
+	dir, err := d.collectionDir(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := d.fs.ReadDir(filepath.Join(dir, indexDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	fields := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasSuffix(entry.Name(), ".tmp") {
+			fields = append(fields, entry.Name())
+		}
+	}
+	return fields, nil
+}
+
+func checkIndexField(field string) error {
+	if err := checkName("field", field); err != nil || field == "" || strings.HasSuffix(field, ".tmp") {
+		return fmt.Errorf("%w: field %q", ErrInvalidName, field)
+	}
+	return nil
+}
+
+// buildIndex indexes field over every record in a collection and saves the
+// index. The caller must hold the collection's write lock.
+func (d *Driver) buildIndex(collection, field string) error {
+	fi := newFieldIndex()
+	files, _, err := d.recordFiles(collection)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		resource, _ := d.resourceName(file)
+		keys, err := d.recordKeys(collection, resource, []string{field})
+		if err != nil {
+			return fmt.Errorf("unable to index %v/%v: %w", collection, resource, err)
+		}
+		if key, ok := keys[field]; ok {
+			fi.add(key, resource)
+		}
+	}
+
+	if err := d.saveIndex(collection, field, fi); err != nil {
+		return err
+	}
+
+	ci, err := d.lockIndexes(collection)
+	if err != nil {
+		return err
+	}
+	defer ci.mu.Unlock()
+	ci.fields[field] = fi
+	return nil
+}
+
+// indexedFields lists the fields a collection has indexes on.
+func (d *Driver) indexedFields(collection string) ([]string, error) {
+	ci, err := d.lockIndexes(collection)
+	if err != nil {
+		return nil, err
+	}
+	defer ci.mu.Unlock()
+
+	fields := make([]string, 0, len(ci.fields))
+	for field := range ci.fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields, nil
+}
+
+// FindBy returns, in name order, the resources in a collection whose field
+// equals value. It uses the field's index when there is one and reads every
+// record otherwise. Numbers compare by value, so 25 finds a stored 25.0.
+func (d *Driver) FindBy(collection, field string, value interface{}) ([]string, error) {
+	if err := d.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	if collection == "" {
+		return nil, fmt.Errorf("%w - unable to search!", ErrMissingCollection)
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return nil, err
+	}
+
+	want, err := valueKey(value)
+	if err != nil {
+		return nil, err
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	ci, err := d.lockIndexes(collection)
+	if err != nil {
+		return nil, err
+	}
+	var found []string
+	fi, indexed := ci.fields[field]
+	if indexed {
+		found = append(found, fi.keys[want]...)
+	}
+	ci.mu.Unlock()
+
+	if !indexed {
+		return d.scanFor(collection, field, want)
+	}
+
+	// expired records stay indexed until they are next touched
+	resources := []string{}
+	for _, resource := range found {
+		if expired, err := d.isExpired(collection, resource); err == nil && !expired {
+			resources = append(resources, resource)
+		}
+	}
+	return resources, nil
+}
+
+// scanFor is FindBy without an index. The caller must hold the collection's
+// lock.
+func (d *Driver) scanFor(collection, field, want string) ([]string, error) {
+	resources := []string{}
+
+	files, _, err := d.recordFiles(collection)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		resource, _ := d.resourceName(file)
+		keys, err := d.fieldKeys(collection, filepath.Join(d.dir, collection, file), []string{field})
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode %v: %w", resource, err)
+		}
+		if key, ok := keys[field]; ok && key == want {
+			resources = append(resources, resource)
+		}
+	}
+	return resources, nil
+}
+
+// recordKeys reads a record and returns the keys of the values it holds
+// for fields. Fields it lacks are left out, as are all of them if the
+// record doesn't exist.
+func (d *Driver) recordKeys(collection, resource string, fields []string) (map[string]string, error) {
+	path, err := d.findRecord(collection, resource)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.fieldKeys(collection, path, fields)
+}
+
+// fieldKeys reads the record at path and returns the keys of the values it
+// holds for fields, leaving out the fields it lacks.
+func (d *Driver) fieldKeys(collection, path string, fields []string) (map[string]string, error) {
+	b, err := d.readRecord(path)
+	if err != nil {
+		return nil, err
+	}
+
+	record := map[string]interface{}{}
+	if err := d.decodeFields(collection, b, &record); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]string, len(fields))
+	for _, field := range fields {
+		v, ok := lookupField(record, strings.Split(field, "."))
+		if !ok {
+			continue
+		}
+		if keys[field], err = valueKey(v); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// valueKey turns a field value into the string it is indexed under.
+// Numbers are keyed by value, everything else by its JSON encoding.
+func valueKey(v interface{}) (string, error) {
+	if n, ok := number(v); ok {
+		return strconv.FormatFloat(n, 'g', -1, 64), nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("unable to index value %v: %w", v, err)
+	}
+	return string(b), nil
+}
+
+// updateIndexes brings a collection's indexes in line with a change to one
+// of its records, or forgets them along with the collection when resource
+// is empty. The caller must hold the record's lock or the collection's.
+func (d *Driver) updateIndexes(op Op, collection, resource string) {
+	if resource == "" {
+		d.indexMu.Lock()
+		defer d.indexMu.Unlock()
+		for name := range d.indexes {
+			if name == collection || strings.HasPrefix(name, collection+"/") {
+				delete(d.indexes, name)
+			}
+		}
+		return
+	}
+
+	ci, err := d.lockIndexes(collection)
+	if err != nil {
+		d.logger().Warn("Unable to load indexes of %v: %v\n", collection, err)
+		return
+	}
+	fields := make([]string, 0, len(ci.fields))
+	for field := range ci.fields {
+		fields = append(fields, field)
+	}
+	ci.mu.Unlock()
+	if len(fields) == 0 {
+		return
+	}
+
+	// read the record without holding the index lock; the caller's lock
+	// keeps it from changing meanwhile
+	var keys map[string]string
+	if op == OpWrite {
+		keys, err = d.recordKeys(collection, resource, fields)
+	}
+
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	for _, field := range fields {
+		fi, ok := ci.fields[field]
+		if !ok {
+			continue
+		}
+		if err != nil {
+			d.dropIndex(ci, collection, field, err)
+			continue
+		}
+		if err := d.reindex(collection, field, fi, resource, keys); err != nil {
+			d.dropIndex(ci, collection, field, err)
+		}
+	}
+}
+
+// reindex moves resource to its key in keys, or out of fi if keys lacks
+// field, and saves the files of the keys that changed. The caller must
+// hold the collection's index lock.
+func (d *Driver) reindex(collection, field string, fi *fieldIndex, resource string, keys map[string]string) error {
+	old, had := fi.resources[resource]
+	key, has := keys[field]
+	if had && has && old == key {
+		return nil
+	}
+
+	if has {
+		fi.add(key, resource)
+		if err := d.saveKey(collection, field, fi, key); err != nil {
+			return err
+		}
+	} else if had {
+		fi.remove(old, resource)
+	}
+	if had {
+		return d.saveKey(collection, field, fi, old)
+	}
+	return nil
+}
+
+// dropIndex gives up on an index that could not be kept up to date, rather
+// than leave FindBy answering from stale data. The caller must hold ci.mu.
+func (d *Driver) dropIndex(ci *collectionIndexes, collection, field string, err error) {
+	d.logger().Warn("Dropping index %v of %v, call CreateIndex to rebuild it: %v\n", field, collection, err)
+	delete(ci.fields, field)
+	d.fs.RemoveAll(filepath.Join(d.dir, collection, indexDir, field))
+}
+
+// collectionIndexes returns the entry for a collection's indexes, which
+// may not be loaded yet.
+func (d *Driver) collectionIndexes(collection string) *collectionIndexes {
+	d.indexMu.Lock()
+	defer d.indexMu.Unlock()
+
+	ci, ok := d.indexes[collection]
+	if !ok {
+		ci = &collectionIndexes{}
+		d.indexes[collection] = ci
+	}
+	return ci
+}
+
+// lockIndexes locks a collection's indexes, loading them from disk the
+// first time. The caller must unlock ci.mu when done.
+func (d *Driver) lockIndexes(collection string) (*collectionIndexes, error) {
+	ci := d.collectionIndexes(collection)
+	ci.mu.Lock()
+	if ci.fields != nil {
+		return ci, nil
+	}
+
+	fields, err := d.indexFiles(collection)
+	if err != nil {
+		ci.mu.Unlock()
+		return nil, err
+	}
+
+	loaded := make(map[string]*fieldIndex, len(fields))
+	for _, field := range fields {
+		fi, err := d.loadIndex(collection, field)
+		if err != nil {
+			ci.mu.Unlock()
+			return nil, fmt.Errorf("unable to load index %v of %v: %w", field, collection, err)
+		}
+		loaded[field] = fi
+	}
+	ci.fields = loaded
+	return ci, nil
+}
+
+// loadIndex reads a field's index from disk. The caller must hold the
+// collection's index lock.
+func (d *Driver) loadIndex(collection, field string) (*fieldIndex, error) {
+	path := filepath.Join(d.dir, collection, indexDir, field)
+	entries, err := d.fs.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fi := newFieldIndex()
+
+	// a crash between saving a record's new key and its old one leaves it
+	// under both; its record says which is right
+	var doubled []string
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		idx, err := d.readIndexFile(filepath.Join(path, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		fi.merge(idx, func(resource string) { doubled = append(doubled, resource) })
+	}
+
+	for _, resource := range doubled {
+		keys, err := d.recordKeys(collection, resource, []string{field})
+		if err != nil {
+			return nil, err
+		}
+		old := make(map[string]bool)
+		for key, resources := range fi.keys {
+			if i := sort.SearchStrings(resources, resource); i < len(resources) && resources[i] == resource {
+				old[key] = true
+			}
+		}
+		for key := range old {
+			fi.remove(key, resource)
+		}
+		if key, ok := keys[field]; ok {
+			fi.add(key, resource)
+			old[key] = true
+		}
+		for key := range old {
+			if err := d.saveKey(collection, field, fi, key); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return fi, nil
+}
+
+// merge adds the entries of idx to fi, passing doubled each resource that
+// fi already has under another key.
+func (fi *fieldIndex) merge(idx index, doubled func(resource string)) {
+	for key, resources := range idx {
+		for _, resource := range resources {
+			if _, ok := fi.resources[resource]; ok {
+				doubled(resource)
+				// keep both until the record settles it
+				list := fi.keys[key]
+				i := sort.SearchStrings(list, resource)
+				fi.keys[key] = append(list[:i], append([]string{resource}, list[i:]...)...)
+				continue
+			}
+			fi.add(key, resource)
+		}
+	}
+}
+
+// readIndexFile reads one of an index's files.
+func (d *Driver) readIndexFile(path string) (index, error) {
+	b, err := d.fs.ReadFile(path)
+	if err == nil && d.aead != nil {
+		b, err = unseal(d.aead, b)
+	}
+	idx := index{}
+	if err == nil {
+		err = json.Unmarshal(b, &idx)
+	}
+	return idx, err
+}
+
+// saveIndex writes the whole of a field's index to disk, replacing the
+// previous one. It is built in a temp directory and swapped in; a crash
+// part way through the swap leaves the field without an index, so FindBy
+// reads the records instead.
+func (d *Driver) saveIndex(collection, field string, fi *fieldIndex) error {
+	cfg := d.config(collection)
+	path := filepath.Join(d.dir, collection, indexDir, field)
+	tmp := path + ".tmp"
+
+	if err := d.fs.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := d.fs.MkdirAll(tmp, cfg.dirPerm); err != nil {
+		return err
+	}
+
+	buckets := make(map[string]index)
+	for key, resources := range fi.keys {
+		name := keyFile(key)
+		if buckets[name] == nil {
+			buckets[name] = index{}
+		}
+		buckets[name][key] = resources
+	}
+	for name, idx := range buckets {
+		if err := d.writeIndexFile(filepath.Join(tmp, name), idx, cfg.filePerm); err != nil {
+			d.fs.RemoveAll(tmp)
+			return err
+		}
+	}
+
+	if err := d.fs.RemoveAll(path); err != nil {
+		return err
+	}
+	return d.fs.Rename(tmp, path)
+}
+
+// saveKey rewrites the file holding key in a field's index, or removes it
+// once no resource holds a key stored in it.
+func (d *Driver) saveKey(collection, field string, fi *fieldIndex, key string) error {
+	cfg := d.config(collection)
+	dir := filepath.Join(d.dir, collection, indexDir, field)
+	name := keyFile(key)
+
+	// keys whose hashes collide share a file
+	idx := index{}
+	path := filepath.Join(dir, name)
+	if stored, err := d.readIndexFile(path); err == nil {
+		for k := range stored {
+			if k != key && keyFile(k) == name {
+				idx[k] = fi.keys[k]
+			}
+		}
+	}
+	if resources, ok := fi.keys[key]; ok {
+		idx[key] = resources
+	}
+
+	if len(idx) == 0 {
+		if err := d.fs.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	if err := d.fs.MkdirAll(dir, cfg.dirPerm); err != nil {
+		return err
+	}
+	return d.writeIndexFile(path, idx, cfg.filePerm)
+}
+
+// writeIndexFile writes one of an index's files, encrypted like the
+// records when the database is.
+func (d *Driver) writeIndexFile(path string, idx index, perm os.FileMode) error {
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	if d.aead != nil {
+		if b, err = seal(d.aead, b); err != nil {
+			return err
+		}
+	}
+
+	if err := d.fs.WriteFile(path+".tmp", b, perm, d.sync); err != nil {
+		d.fs.Remove(path + ".tmp")
+		return err
+	}
+	return d.fs.Rename(path+".tmp", path)
+}
+
+// keyFile names the file a key of an index is stored in.
+func keyFile(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
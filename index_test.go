@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func findBy(t *testing.T, d *Driver, collection, field string, value interface{}) string {
+	t.Helper()
+	found, err := d.FindBy(collection, field, value)
+	if err != nil {
+		t.Fatalf("FindBy(%v, %v) = %v", field, value, err)
+	}
+	return strings.Join(found, ",")
+}
+
+func TestIndexKeptUpToDate(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	for _, u := range []User{{Name: "a", Address: Address{City: "Pune"}}, {Name: "b", Address: Address{City: "Pune"}}} {
+		if err := d.Write("users", u.Name, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.CreateIndex("users", "Address.City"); err != nil {
+		t.Fatal(err)
+	}
+	if got := findBy(t, d, "users", "Address.City", "Pune"); got != "a,b" {
+		t.Fatalf("FindBy(Pune) = %v, want a,b", got)
+	}
+
+	if err := d.Write("users", "a", User{Name: "a", Address: Address{City: "Delhi"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write("users", "c", User{Name: "c", Address: Address{City: "Pune"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete("users", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if got := findBy(t, d, "users", "Address.City", "Pune"); got != "c" {
+		t.Errorf("FindBy(Pune) = %v, want c", got)
+	}
+	if got := findBy(t, d, "users", "Address.City", "Delhi"); got != "a" {
+		t.Errorf("FindBy(Delhi) = %v, want a", got)
+	}
+
+	// a fresh driver reads the same answers back from disk
+	reopened, err := New(d.Dir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if got := findBy(t, reopened, "users", "Address.City", "Pune"); got != "c" {
+		t.Errorf("reopened FindBy(Pune) = %v, want c", got)
+	}
+	if got := findBy(t, reopened, "users", "Address.City", "Delhi"); got != "a" {
+		t.Errorf("reopened FindBy(Delhi) = %v, want a", got)
+	}
+}
+
+func TestIndexConcurrentWrites(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	for _, collection := range []string{"users", "staff"} {
+		if err := d.Write(collection, "seed", User{Name: "seed"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.CreateIndex(collection, "Company"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			collection := []string{"users", "staff"}[g%2]
+			for i := 0; i < 20; i++ {
+				name := fmt.Sprintf("u%d-%d", g, i)
+				d.Write(collection, name, User{Name: name, Company: fmt.Sprintf("c%d", i%3)})
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for _, collection := range []string{"users", "staff"} {
+		for c := 0; c < 3; c++ {
+			indexed, err := d.FindBy(collection, "Company", fmt.Sprintf("c%d", c))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, _ := valueKey(fmt.Sprintf("c%d", c))
+			scanned, err := d.scanFor(collection, "Company", want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(indexed, ",") != strings.Join(scanned, ",") {
+				t.Errorf("%v c%d: index has %v, records have %v", collection, c, indexed, scanned)
+			}
+		}
+	}
+}
+
+func TestIndexDoubledEntrySettledByRecord(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	if err := d.Write("users", "a", User{Name: "a", Company: "New"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateIndex("users", "Company"); err != nil {
+		t.Fatal(err)
+	}
+
+	// as if a crash came between saving a's new key and removing its old one
+	old, _ := valueKey("Old")
+	path := filepath.Join(d.Dir(), "users", indexDir, "Company", keyFile(old))
+	b, _ := json.Marshal(index{old: {"a"}})
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := New(d.Dir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if got := findBy(t, reopened, "users", "Company", "Old"); got != "" {
+		t.Errorf("FindBy(Old) = %v, want nothing", got)
+	}
+	if got := findBy(t, reopened, "users", "Company", "New"); got != "a" {
+		t.Errorf("FindBy(New) = %v, want a", got)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("stale index file left: %v", err)
+	}
+}
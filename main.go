@@ -1,11 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/cipher"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
 	"github.com/jcelliott/lumber"
 )
 
@@ -22,164 +35,2849 @@ type (
 	}
 
 	Driver struct{
-		mutex sync.Mutex
-		mutexes map[string]*sync.Mutex
+		*shared
 		dir string
+		root string
 		log Logger
+		sync bool
+		dirPerm os.FileMode
+		filePerm os.FileMode
+		codec Codec
+		ext string
+		compress bool
+		aead cipher.AEAD
+		checksum bool
+		schemas map[string]map[string]interface{}
+		types map[string]typeCheck
+		configs map[string]collectionConfig
+		softDelete bool
+		dryRun bool
+		caseInsensitive bool
+		tempDir string
+		tempSeq atomic.Uint64
+		fs Storage
+		closed atomic.Bool
+		derived bool
+		buffer *bufferedStorage
+		stopFlush chan struct{}
+		setup sync.Once
+		setupErr error
 	}
 )
 
+var (
+	ErrMissingCollection = errors.New("Missing collection")
+	ErrMissingResource   = errors.New("Missing resource")
+	ErrNotFound          = errors.New("not found")
+
+	// ErrCollectionNotFound and ErrResourceNotFound tell a missing
+	// collection from a missing record in an existing one. Both match
+	// ErrNotFound and fs.ErrNotExist.
+	ErrCollectionNotFound error = notFoundError("collection")
+	ErrResourceNotFound   error = notFoundError("resource")
+
+	ErrExists            = errors.New("already exists")
+	ErrInvalidName       = errors.New("invalid name")
+	ErrClosed            = errors.New("database is closed")
+	ErrTimeout           = errors.New("timed out")
+	ErrChecksumMismatch  = errors.New("checksum mismatch")
+	ErrVersionConflict   = errors.New("version conflict")
+	ErrReadOnly          = errors.New("read-only")
+)
+
+// nopLogger discards everything. It is the default, so embedding the driver
+// produces no output unless asked to.
+type nopLogger struct{}
+
+func (nopLogger) Fatal(string, ...interface{}) {}
+func (nopLogger) Error(string, ...interface{}) {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Trace(string, ...interface{}) {}
+
+// logger returns the driver's logger, or a nopLogger for a Driver that was
+// made without New and so has none.
+func (d *Driver) logger() Logger {
+	if d.log == nil {
+		return nopLogger{}
+	}
+	return d.log
+}
+
 type Options struct {
 	Logger
+
+	// LogLevel, when Logger is not set, logs to the console at that level
+	// and above: "trace", "debug", "info", "warn", "error" or "fatal".
+	// With neither set nothing is logged.
+	LogLevel string
+
+	// Sync makes Write fsync the record and its directory before returning,
+	// so an acknowledged write survives a crash. Every write then waits on the
+	// disk, which is typically orders of magnitude slower than leaving the
+	// data in the page cache.
+	Sync bool
+
+	// FlushInterval, when positive, buffers writes in memory and writes
+	// them to disk in a batch every interval, trading durability for
+	// throughput: writes acknowledged since the last flush are lost in a
+	// crash. Reads see buffered writes. Flush and Close write the buffer out
+	// early.
+	FlushInterval time.Duration
+
+	// FlushSize, when positive, buffers writes like FlushInterval and also
+	// flushes as soon as that many bytes are waiting. Either option turns
+	// buffering on.
+	FlushSize int
+
+	// TempDir, when set, is where records are staged before being renamed
+	// into place, instead of next to them. On the same filesystem as the
+	// database the rename is atomic, exactly as without TempDir. On another
+	// one it can't be, so the staged record is copied next to its final
+	// path, fsynced, renamed into place and only then removed from TempDir:
+	// still all or nothing, but the record is written twice.
+	TempDir string
+
+	// DirPerm and FilePerm are the modes used for new directories and
+	// records. They default to 0755 and 0644.
+	DirPerm  os.FileMode
+	FilePerm os.FileMode
+
+	// Codec controls how records are encoded on disk. It defaults to
+	// JSONCodec.
+	Codec Codec
+
+	// Ext is the file extension given to records, including the leading
+	// dot. It defaults to the codec's own, such as ".json".
+	Ext string
+
+	// Compact writes the default JSON codec's records on a single line
+	// instead of indenting them, which noticeably shrinks large
+	// collections. It has no effect when Codec is set.
+	Compact bool
+
+	// DisableHTMLEscape and UseNumber set the same options on the default
+	// JSON codec; see JSONCodec. They have no effect when Codec is set.
+	DisableHTMLEscape bool
+	UseNumber         bool
+
+	// Compress gzips records on disk, adding a ".gz" suffix to their file
+	// names. Records are decompressed by extension on read, so a database
+	// may hold a mix of compressed and plain records.
+	Compress bool
+
+	// EncryptionKey, when set, encrypts records with AES-256-GCM before they
+	// are written. It must be 32 bytes long.
+	EncryptionKey []byte
+
+	// Checksum stores a CRC-32C with every record and verifies it on read,
+	// failing with ErrChecksumMismatch if the file has been damaged. Records
+	// are verified whenever they carry a checksum, so it can be turned on
+	// for an existing database.
+	Checksum bool
+
+	// CaseInsensitive stores records under lower-cased resource names, so
+	// "John" and "john" are the same record on every platform rather than
+	// only on case-insensitive filesystems. Two names differing only in case
+	// then collide, and names come back lower-cased from ReadAllMap,
+	// Iterate and the like. Records written with uppercase names before it
+	// was turned on can no longer be found.
+	CaseInsensitive bool
+
+	// DryRun makes Delete, DropCollection, Truncate and DeleteWhere log, at
+	// info level, the records they would delete instead of deleting them.
+	// They return as they would have otherwise, counts included, so a
+	// cleanup job can be rehearsed against live data. Other writes are
+	// unaffected.
+	DryRun bool
+
+	// SoftDelete makes Delete and DropCollection move records into a trash
+	// directory instead of removing them, so they can be brought back with
+	// Restore until PurgeTrash is called.
+	SoftDelete bool
+
+	// CacheSize, when positive, keeps up to that many recently read
+	// records in memory so repeated reads skip the disk.
+	CacheSize int
+
+	// InMemory keeps the database in process memory instead of on disk.
+	// Nothing is persisted, which makes it a fast, hermetic stand-in for
+	// tests; the API and locking behave exactly as they do on disk.
+	InMemory bool
+
+	// Storage replaces the filesystem the database is kept on. It defaults
+	// to the local disk, or to process memory when InMemory is set.
+	Storage Storage
+}
+
+func New(dir string, options *Options) (*Driver, error) {
+	d, err := open(dir, options, newShared())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.recoverJournals(); err != nil {
+		return nil, fmt.Errorf("unable to open database: %w", err)
+	}
+	return d, nil
+}
+
+// open is New, with the locks and in-memory state given by s.
+func open(dir string, options *Options, s *shared) (*Driver, error) {
+	if dir == "" {
+		return nil, errors.New("unable to open database (no directory)!")
+	}
+	dir = filepath.Clean(dir)
+	opts := Options{}
+	if options != nil {
+		opts = *options
+	}
+	if opts.Logger == nil {
+		if opts.LogLevel == "" {
+			opts.Logger = nopLogger{}
+		} else {
+			level := lumber.LvlInt(opts.LogLevel)
+			if strings.TrimSpace(lumber.LvlStr(level)) != strings.ToUpper(opts.LogLevel) {
+				return nil, fmt.Errorf("unknown log level %q", opts.LogLevel)
+			}
+			opts.Logger = lumber.NewConsoleLogger(level)
+		}
+	}
+	if opts.DirPerm == 0 {
+		opts.DirPerm = 0755
+	}
+	if opts.FilePerm == 0 {
+		opts.FilePerm = 0644
+	}
+	if opts.Codec == nil {
+		opts.Codec = JSONCodec{Compact: opts.Compact, DisableHTMLEscape: opts.DisableHTMLEscape, UseNumber: opts.UseNumber}
+	}
+	if opts.Ext == "" {
+		opts.Ext = opts.Codec.Ext()
+	}
+	if !strings.HasPrefix(opts.Ext, ".") {
+		opts.Ext = "." + opts.Ext
+	}
+	switch {
+	case opts.Ext == ".", opts.Ext == gzipExt, opts.Ext == ttlExt, opts.Ext == versionExt, opts.Ext == ".tmp", opts.Ext == seqFile,
+		strings.ContainsAny(opts.Ext, "/\\\x00"):
+		return nil, fmt.Errorf("%w: %q can't be used as the record extension", ErrInvalidName, opts.Ext)
+	}
+	if opts.Storage == nil {
+		if opts.InMemory {
+			opts.Storage = newMemStorage()
+		} else {
+			opts.Storage = osStorage{}
+		}
+	}
+	var buffer *bufferedStorage
+	if opts.FlushInterval > 0 || opts.FlushSize > 0 {
+		buffer = newBufferedStorage(opts.Storage, opts.FlushSize)
+		opts.Storage = buffer
+	}
+
+	var aead cipher.AEAD
+	if opts.EncryptionKey != nil {
+		var err error
+		if aead, err = newAEAD(opts.EncryptionKey); err != nil {
+			return nil, err
+		}
+	}
+
+	driver := Driver{
+		shared: s,
+		dir: dir,
+		log: opts.Logger,
+		sync: opts.Sync,
+		dirPerm: opts.DirPerm,
+		filePerm: opts.FilePerm,
+		codec: opts.Codec,
+		ext: opts.Ext,
+		compress: opts.Compress,
+		aead: aead,
+		checksum: opts.Checksum,
+		schemas: make(map[string]map[string]interface{}),
+		types: make(map[string]typeCheck),
+		configs: make(map[string]collectionConfig),
+		softDelete: opts.SoftDelete,
+		dryRun: opts.DryRun,
+		caseInsensitive: opts.CaseInsensitive,
+		tempDir: opts.TempDir,
+		fs: opts.Storage,
+		buffer: buffer,
+		stopFlush: make(chan struct{}),
+	}
+
+	if opts.CacheSize > 0 {
+		driver.cache = newCache(opts.CacheSize)
+	}
+
+	switch fi, err := driver.fs.Stat(dir); {
+	case err == nil && !fi.IsDir():
+		return nil, fmt.Errorf("unable to open database: %v is not a directory", dir)
+	case err == nil:
+		opts.Logger.Debug("Using '%s' (database already exists)\n", dir)
+	case !os.IsNotExist(err):
+		return nil, fmt.Errorf("unable to open database: %w", err)
+	default:
+		opts.Logger.Debug("Creating database at '%s'...\n",dir)
+		if err := driver.fs.MkdirAll(dir, opts.DirPerm); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.TempDir != "" {
+		if err := driver.fs.MkdirAll(opts.TempDir, opts.DirPerm); err != nil {
+			return nil, fmt.Errorf("unable to create temp dir: %w", err)
+		}
+	}
+
+	driver.root = dir
+	if r, ok := driver.fs.(resolver); ok {
+		root, err := r.EvalSymlinks(dir)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open database: %w", err)
+		}
+		driver.root = root
+	}
+
+	if buffer != nil && opts.FlushInterval > 0 {
+		go driver.flushEvery(opts.FlushInterval)
+	}
+	return &driver, nil
+}
+
+// flushEvery flushes the write buffer on every tick until Close.
+func (d *Driver) flushEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := d.buffer.Flush(); err != nil {
+				d.logger().Error("Unable to flush buffered writes: %v\n", err)
+			}
+		case <-d.stopFlush:
+			return
+		}
+	}
+}
+
+// Flush writes any buffered writes to disk; see Options.FlushInterval. It
+// does nothing when writes are not buffered.
+func (d *Driver) Flush() error {
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+
+	if d.buffer == nil {
+		return nil
+	}
+	return d.buffer.Flush()
+}
+
+// Close shuts the database down: buffered writes are flushed, watch
+// channels are closed and every later call returns ErrClosed. Operations
+// already in progress are allowed to finish. Closing a closed database
+// returns ErrClosed.
+func (d *Driver) Close() error {
+	if !d.closed.CompareAndSwap(false, true) {
+		return ErrClosed
+	}
+
+	// a Driver made without New has no stopFlush until it is defaulted
+	d.defaults()
+	close(d.stopFlush)
+
+	// watchers belong to the driver everything else was derived from
+	if !d.derived {
+		d.watchMu.Lock()
+		for _, chans := range d.watchers {
+			for ch := range chans {
+				close(ch)
+			}
+		}
+		d.watchers = make(map[string]map[chan Event]struct{})
+		d.watchMu.Unlock()
+	}
+
+	if d.buffer != nil {
+		return d.buffer.Flush()
+	}
+	return nil
+}
+
+// Dir returns the database's root directory.
+func (d *Driver) Dir() string {
+	return d.dir
+}
+
+// Path returns the file a record is stored in, including its extension.
+// For a record that doesn't exist yet it is where Write would put it. The
+// names are not validated.
+func (d *Driver) Path(collection, resource string) string {
+	d.defaults()
+	if path, err := d.findRecord(collection, resource); err == nil {
+		return path
+	}
+	return d.recordPath(collection, resource)
+}
+
+func (d *Driver) checkOpen() error {
+	if d.closed.Load() {
+		return ErrClosed
+	}
+	return d.defaults()
+}
+
+// defaults fills in, the first time it is called, what New would have set
+// on a Driver made without New, such as &Driver{dir: dir}: the options'
+// defaults, the local disk and locks of its own. Such a driver then works
+// like one from New with no options. Fields that are already set, as they
+// all are on a driver from New, are left alone.
+func (d *Driver) defaults() error {
+	d.setup.Do(func() {
+		if d.shared == nil {
+			d.shared = newShared()
+		}
+		if d.log == nil {
+			d.log = nopLogger{}
+		}
+		if d.dirPerm == 0 {
+			d.dirPerm = 0755
+		}
+		if d.filePerm == 0 {
+			d.filePerm = 0644
+		}
+		if d.codec == nil {
+			d.codec = JSONCodec{}
+		}
+		if d.ext == "" {
+			d.ext = d.codec.Ext()
+		}
+		if d.schemas == nil {
+			d.schemas = make(map[string]map[string]interface{})
+		}
+		if d.types == nil {
+			d.types = make(map[string]typeCheck)
+		}
+		if d.configs == nil {
+			d.configs = make(map[string]collectionConfig)
+		}
+		if d.stopFlush == nil {
+			d.stopFlush = make(chan struct{})
+		}
+
+		if d.dir == "" {
+			d.setupErr = errors.New("unable to open database (no directory)!")
+			return
+		}
+		if d.fs == nil {
+			d.dir = filepath.Clean(d.dir)
+			d.fs = osStorage{}
+			if err := d.fs.MkdirAll(d.dir, d.dirPerm); err != nil {
+				d.setupErr = fmt.Errorf("unable to open database: %w", err)
+				return
+			}
+		}
+		if d.root == "" {
+			d.root = d.dir
+			if r, ok := d.fs.(resolver); ok {
+				root, err := r.EvalSymlinks(d.dir)
+				if err != nil {
+					d.setupErr = fmt.Errorf("unable to open database: %w", err)
+					return
+				}
+				d.root = root
+			}
+		}
+	})
+	return d.setupErr
+}
+
+// Ping checks that the database is open and its directory writable, by
+// creating and removing a small temp file there. No record is touched, so
+// it is cheap enough for a readiness probe.
+func (d *Driver) Ping() error {
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+
+	// go past the write buffer, which would otherwise keep the file in memory
+	storage := d.fs
+	if d.buffer != nil {
+		storage = d.buffer.Storage
+	}
+
+	path := filepath.Join(d.dir, fmt.Sprintf("%sping-%d-%d.tmp", tempPrefix, os.Getpid(), d.tempSeq.Add(1)))
+	if err := storage.WriteFile(path, []byte("ping"), d.filePerm, d.sync); err != nil {
+		storage.Remove(path)
+		return fmt.Errorf("database %v is not writable: %w", d.dir, err)
+	}
+	return storage.Remove(path)
+}
+
+// Write saves v as a record, creating its collection if needed. Collections
+// can be nested by separating their names with '/', as in "users/active";
+// each level is a directory and may hold records of its own.
+func (d *Driver) Write(collection, resource string, v interface{}) error {
+	return d.WriteContext(context.Background(), collection, resource, v)
+}
+
+// WriteContext is Write but gives up early once ctx is cancelled, even in
+// the middle of an fsync or rename that storage is slow to finish: it
+// returns ctx.Err() straight away and leaves the call to finish in the
+// background, holding the record's lock until it does. A write cancelled
+// while it is being staged never takes effect, though its temp file may
+// linger until Vacuum removes it; one cancelled during its rename may
+// still take effect.
+func (d *Driver) WriteContext(ctx context.Context, collection, resource string, v interface{}) error {
+	_, err := d.writeN(ctx, collection, resource, v)
+	return err
+}
+
+// WriteN is Write, but also returns the number of bytes stored: the size of
+// the record on disk, after any compression and encryption.
+func (d *Driver) WriteN(collection, resource string, v interface{}) (int, error) {
+	return d.writeN(context.Background(), collection, resource, v)
+}
+
+// WriteTimeout is Write, but gives up with ErrTimeout if the record can't be
+// locked within timeout. Once the lock is held the write itself is not
+// interrupted.
+func (d *Driver) WriteTimeout(collection, resource string, v interface{}, timeout time.Duration) error {
+	if err := d.validate(collection, resource); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	wait := time.Millisecond
+	for {
+		unlock, ok := d.tryLockRecord(collection, resource, true)
+		if ok {
+			defer unlock()
+			break
+		}
+
+		left := time.Until(deadline)
+		if left <= 0 {
+			return fmt.Errorf("%w: unable to lock %v/%v within %v", ErrTimeout, collection, resource, timeout)
+		}
+		time.Sleep(min(wait, left))
+		wait = min(2*wait, 50*time.Millisecond)
+	}
+
+	_, err := d.write(collection, resource, v)
+	return err
+}
+
+// TryWrite is Write, but returns false without writing if the record, or
+// its collection, is locked at that moment.
+func (d *Driver) TryWrite(collection, resource string, v interface{}) (bool, error) {
+	if err := d.validate(collection, resource); err != nil {
+		return false, err
+	}
+
+	unlock, ok := d.tryLockRecord(collection, resource, true)
+	if !ok {
+		return false, nil
+	}
+	defer unlock()
+
+	if _, err := d.write(collection, resource, v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (d *Driver) writeN(ctx context.Context, collection, resource string, v interface{}) (int, error) {
+	if err := d.validate(collection, resource); err != nil {
+		return 0, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	unlock := d.lockRecord(collection, resource, true)
+	if ctx.Done() == nil {
+		defer unlock()
+		return d.write(collection, resource, v)
+	}
+
+	run, release := cancellable(ctx, unlock)
+	defer release()
+	return d.writeWith(run, collection, resource, v)
+}
+
+// cancellable returns a run func that performs each blocking step in its
+// own goroutine and gives up waiting with ctx.Err() once ctx is done,
+// along with a release func to call in place of unlock when finished. The
+// first step given up on keeps the lock: unlock is called when that step
+// returns instead, so nothing else touches the record while it runs.
+func cancellable(ctx context.Context, unlock func()) (run func(step func() error) error, release func()) {
+	abandoned := false
+	run = func(step func() error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		done := make(chan error, 1)
+		go func() { done <- step() }()
+
+		select {
+		case err := <-done:
+			return err
+		case <-ctx.Done():
+			abandoned = true
+			go func() {
+				<-done
+				unlock()
+			}()
+			return ctx.Err()
+		}
+	}
+	release = func() {
+		if !abandoned {
+			unlock()
+		}
+	}
+	return run, release
+}
+
+// Upsert is Write, but also reports whether the record is new rather than
+// a replacement. An expired record counts as absent.
+func (d *Driver) Upsert(collection, resource string, v interface{}) (created bool, err error) {
+	if err := d.validate(collection, resource); err != nil {
+		return false, err
+	}
+
+	unlock := d.lockRecord(collection, resource, true)
+	defer unlock()
+
+	_, err = d.findRecord(collection, resource)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	created = err != nil
+
+	if _, err := d.write(collection, resource, v); err != nil {
+		return false, err
+	}
+	return created, nil
+}
+
+// Update runs a read-modify-write cycle on a record while holding the
+// collection's write lock, so no other writer can interleave. fn receives
+// the stored bytes, or nil if the record does not exist yet, and returns
+// the value to persist.
+func (d *Driver) Update(collection, resource string, fn func(raw []byte) (interface{}, error)) error {
+	if err := d.validate(collection, resource); err != nil {
+		return err
+	}
+
+	unlock := d.lockRecord(collection, resource, true)
+	defer unlock()
+
+	var b []byte
+	if path, err := d.findRecord(collection, resource); err == nil {
+		if b, err = d.readRecord(path); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	v, err := fn(b)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.write(collection, resource, v)
+	return err
+}
+
+// Increment adds delta to an integer field at the top level of a record and
+// returns the new value. A missing field, or missing record, starts at 0.
+// The read and write happen under one lock, so concurrent increments never
+// lose an update.
+func (d *Driver) Increment(collection, resource, field string, delta int64) (int64, error) {
+	if field == "" {
+		return 0, fmt.Errorf("unable to increment %v/%v (no field)!", collection, resource)
+	}
+
+	var n int64
+	err := d.Update(collection, resource, func(raw []byte) (interface{}, error) {
+		record := map[string]interface{}{}
+		if raw != nil {
+			if err := d.decodeFields(collection, raw, &record); err != nil {
+				return nil, err
+			}
+		}
+
+		if v, ok := record[field]; ok {
+			var err error
+			if n, err = toInt64(v); err != nil {
+				return nil, fmt.Errorf("unable to increment %v/%v: field %q: %w", collection, resource, field, err)
+			}
+		}
+
+		n += delta
+		record[field] = n
+		return record, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Patch applies an RFC 7386 JSON merge patch to a record: each field of
+// patch replaces the record's, a null deletes it, and objects are merged
+// field by field rather than replaced. The read and write happen under one
+// lock, as with Update. Patching a record that doesn't exist fails with
+// ErrNotFound.
+func (d *Driver) Patch(collection, resource string, patch map[string]interface{}) error {
+	return d.Update(collection, resource, func(raw []byte) (interface{}, error) {
+		if raw == nil {
+			return nil, d.recordNotFound(collection, fmt.Errorf("%v/%v: %w", collection, resource, os.ErrNotExist))
+		}
+
+		record := map[string]interface{}{}
+		if err := d.decodeFields(collection, raw, &record); err != nil {
+			return nil, err
+		}
+		return mergePatch(record, patch), nil
+	})
+}
+
+// mergePatch merges patch into target, which it modifies and returns.
+func mergePatch(target, patch map[string]interface{}) map[string]interface{} {
+	if target == nil {
+		target = map[string]interface{}{}
+	}
+	for key, v := range patch {
+		switch v := v.(type) {
+		case nil:
+			delete(target, key)
+		case map[string]interface{}:
+			into, _ := target[key].(map[string]interface{})
+			target[key] = mergePatch(into, v)
+		default:
+			target[key] = v
+		}
+	}
+	return target
+}
+
+// decodeFields decodes a record of collection into a generic map. JSON
+// numbers are kept as json.Number so other fields are written back exactly
+// as they were.
+func (d *Driver) decodeFields(collection string, raw []byte, record *map[string]interface{}) error {
+	codec := d.config(collection).codec
+	if _, ok := codec.(JSONCodec); !ok {
+		return codec.Unmarshal(raw, record)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	return dec.Decode(record)
+}
+
+// toInt64 converts the integer types codecs decode to, including json.Number
+// and numeric strings such as the example's Age field, to an int64.
+func toInt64(v interface{}) (int64, error) {
+	switch n := v.(type) {
+	case json.Number:
+		return n.Int64()
+	case string:
+		return strconv.ParseInt(n, 10, 64)
+	case int:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	case uint64:
+		if n > math.MaxInt64 {
+			return 0, fmt.Errorf("%v overflows int64", n)
+		}
+		return int64(n), nil
+	case float64:
+		if n != math.Trunc(n) || n < math.MinInt64 || n >= math.MaxInt64 {
+			return 0, fmt.Errorf("%v is not an integer", n)
+		}
+		return int64(n), nil
+	}
+	return 0, fmt.Errorf("%v is not a number", v)
+}
+
+// Insert writes v under a newly assigned ID and returns that ID. IDs count up
+// from 1 per collection, and the last one handed out is kept in a counter
+// file inside the collection.
+func (d *Driver) Insert(collection string, v interface{}) (string, error) {
+	if err := d.checkOpen(); err != nil {
+		return "", err
+	}
+
+	if collection == "" {
+		return "", fmt.Errorf("%w - no place to save record!", ErrMissingCollection)
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return "", err
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if err := d.ensureCollection(collection); err != nil {
+		return "", err
+	}
+
+	seq, err := d.readSeq(collection)
+	if err != nil {
+		return "", err
+	}
+
+	// skip over IDs already taken by records written by hand
+	var id string
+	for {
+		seq++
+		id = strconv.FormatUint(seq, 10)
+		if _, err := d.findRecord(collection, id); errors.Is(err, os.ErrNotExist) {
+			break
+		} else if err != nil {
+			return "", err
+		}
+	}
+
+	if err := d.writeSeq(collection, seq); err != nil {
+		return "", err
+	}
+
+	_, err = d.write(collection, id, v)
+	return id, err
+}
+
+// seqFile holds the last ID Insert assigned in a collection.
+const seqFile = ".seq"
+
+// tempPrefix starts the names of records staged in Options.TempDir.
+const tempPrefix = "godb-"
+
+func (d *Driver) readSeq(collection string) (uint64, error) {
+	b, err := d.fs.ReadFile(filepath.Join(d.dir, collection, seqFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	seq, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("corrupt counter for %v: %w", collection, err)
+	}
+	return seq, nil
+}
+
+func (d *Driver) writeSeq(collection string, seq uint64) error {
+	path := filepath.Join(d.dir, collection, seqFile)
+	b := []byte(strconv.FormatUint(seq, 10) + "\n")
+
+	if err := d.fs.WriteFile(path+".tmp", b, d.config(collection).filePerm, d.sync); err != nil {
+		return err
+	}
+	return d.fs.Rename(path+".tmp", path)
+}
+
+// write persists v and returns its size on disk; the caller must hold the
+// record's write lock, or the collection's.
+func (d *Driver) write(collection, resource string, v interface{}) (int, error) {
+	return d.writeWith(func(step func() error) error { return step() }, collection, resource, v)
+}
+
+// writeWith is write with each step that blocks on storage performed by
+// run, so WriteContext can stop between or during them.
+func (d *Driver) writeWith(run func(step func() error) error, collection, resource string, v interface{}) (int, error) {
+	if err := d.checkOverwrite(collection, resource); err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+
+	var tmpPath string
+	var n int
+	err := run(func() (err error) {
+		tmpPath, n, err = d.stage(collection, resource, v, d.sync)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := run(func() error { return d.commit(collection, resource, tmpPath) }); err != nil {
+		return 0, err
+	}
+
+	if d.sync {
+		if err := run(func() error { return d.fs.SyncDir(filepath.Join(d.dir, collection)) }); err != nil {
+			return 0, err
+		}
+	}
+
+	d.logger().Trace("Wrote %v/%v: %d bytes in %v\n", collection, resource, n, time.Since(start))
+	return n, nil
+}
+
+// stage encodes v into a temp file next to its final path and returns the
+// temp file's path and size. With sync set the temp file is fsynced.
+func (d *Driver) stage(collection, resource string, v interface{}, sync bool) (string, int, error) {
+	if err := d.validateRecord(collection, resource, v); err != nil {
+		return "", 0, err
+	}
+
+	tmpPath, err := d.tempPath(collection, resource)
+	if err != nil {
+		return "", 0, err
+	}
+
+	cfg := d.config(collection)
+	b, err := cfg.codec.Marshal(v)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if b, err = d.encode(b, cfg.compress); err != nil {
+		return "", 0, err
+	}
+
+	if err := d.fs.WriteFile(tmpPath, b, cfg.filePerm, sync); err != nil {
+		d.fs.Remove(tmpPath)
+		return "", 0, err
+	}
+	return tmpPath, len(b), nil
+}
+
+// tempPath returns the path to stage a record at, next to its final path
+// or in TempDir, creating the collection if needed.
+func (d *Driver) tempPath(collection, resource string) (string, error) {
+	tmpPath := d.recordPath(collection, resource) + ".tmp"
+
+	if err := d.confine(tmpPath); err != nil {
+		return "", err
+	}
+	if d.tempDir != "" {
+		tmpPath = filepath.Join(d.tempDir, fmt.Sprintf("%s%d-%d.tmp", tempPrefix, os.Getpid(), d.tempSeq.Add(1)))
+	}
+
+	if err := d.ensureCollection(collection); err != nil {
+		return "", err
+	}
+	return tmpPath, nil
+}
+
+// ensureCollection creates a collection's directory, and those of the
+// collections it is nested in, if they don't exist yet. Collection
+// directories are only created and removed under dirMu, so a collection is
+// never created half way through the deletion or replacement of one it is
+// nested in, and Storage never sees two goroutines create one at once.
+func (d *Driver) ensureCollection(collection string) error {
+	dir := filepath.Join(d.dir, collection)
+	if fi, err := d.fs.Stat(dir); err == nil && fi.IsDir() {
+		return nil
+	}
+
+	d.dirMu.Lock()
+	defer d.dirMu.Unlock()
+	return d.fs.MkdirAll(dir, d.config(collection).dirPerm)
+}
+
+// commit renames a staged temp file into place.
+func (d *Driver) commit(collection, resource, tmpPath string) error {
+	return d.install(collection, resource, tmpPath, d.recordPath(collection, resource))
+}
+
+// install renames a staged temp file to fnlPath, then clears what the
+// record it replaces leaves behind.
+func (d *Driver) install(collection, resource, tmpPath, fnlPath string) error {
+	cfg := d.config(collection)
+
+	err := d.fs.Rename(tmpPath, fnlPath)
+	if errors.Is(err, syscall.EXDEV) {
+		err = d.commitAcross(tmpPath, fnlPath, cfg.filePerm)
+	}
+	if err != nil {
+		return err
+	}
+
+	// drop the copy in the other format, if the Compress setting changed
+	stale := strings.TrimSuffix(fnlPath, gzipExt)
+	if stale == fnlPath {
+		stale += gzipExt
+	}
+	if err := d.fs.Remove(stale); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// a fresh write replaces any previous expiry
+	if err := d.fs.Remove(d.ttlPath(collection, resource)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := d.bumpVersion(collection, resource); err != nil {
+		return err
+	}
+
+	d.changed(OpWrite, collection, resource)
+	return nil
+}
+
+// commitAcross moves a record staged in TempDir on another filesystem into
+// place. Renames can't cross filesystems, so it is copied next to its final
+// path, made durable there and renamed, keeping the write atomic; the
+// staged copy is removed last.
+func (d *Driver) commitAcross(tmpPath, fnlPath string, perm os.FileMode) error {
+	b, err := d.fs.ReadFile(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	if err := d.fs.WriteFile(fnlPath+".tmp", b, perm, true); err != nil {
+		d.fs.Remove(fnlPath + ".tmp")
+		return err
+	}
+	if err := d.fs.Rename(fnlPath+".tmp", fnlPath); err != nil {
+		return err
+	}
+	return d.fs.Remove(tmpPath)
+}
+
+// WriteBatch writes several records to a collection under a single lock.
+//
+// Every record is first encoded to a temp file; if any of them fails, the
+// temp files are removed and nothing is changed. Only then are they renamed
+// into place. A rename failing part way through that second step (which
+// needs the disk to fail under us) leaves the records renamed so far in
+// place.
+func (d *Driver) WriteBatch(collection string, items map[string]interface{}) error {
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+
+	if collection == "" {
+		return fmt.Errorf("%w - no place to save records!", ErrMissingCollection)
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	resources := make([]string, 0, len(items))
+	for resource := range items {
+		if resource == "" {
+			return fmt.Errorf("%w - unable to save record (no name)!", ErrMissingResource)
+		}
+		if err := checkResource(resource); err != nil {
+			return err
+		}
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, resource := range resources {
+		if err := d.checkOverwrite(collection, resource); err != nil {
+			return err
+		}
+	}
+
+	staged := make([]string, 0, len(resources))
+	for _, resource := range resources {
+		tmpPath, _, err := d.stage(collection, resource, items[resource], d.sync)
+		if err != nil {
+			for _, tmpPath := range staged {
+				d.fs.Remove(tmpPath)
+			}
+			return fmt.Errorf("unable to write %v: %w", resource, err)
+		}
+		staged = append(staged, tmpPath)
+	}
+
+	for i, resource := range resources {
+		if err := d.commit(collection, resource, staged[i]); err != nil {
+			for _, tmpPath := range staged[i+1:] {
+				d.fs.Remove(tmpPath)
+			}
+			return fmt.Errorf("unable to write %v: %w", resource, err)
+		}
+	}
+
+	if d.sync {
+		return d.fs.SyncDir(filepath.Join(d.dir, collection))
+	}
+	return nil
+}
+
+// ReplaceCollection replaces every record in a collection with items, as a
+// single step: the new records are written to a fresh directory that is
+// then renamed over the old one, so readers see either the old records or
+// the new, never a mix. Records not in items are gone afterwards, and the
+// new ones start with no expiry or version. Nested collections and indexes
+// are kept, the indexes rebuilt over the new records. The collection is
+// created if it doesn't exist.
+func (d *Driver) ReplaceCollection(collection string, items map[string]interface{}) error {
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+
+	if collection == "" {
+		return fmt.Errorf("%w - no place to save records!", ErrMissingCollection)
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	resources := make([]string, 0, len(items))
+	for resource := range items {
+		if resource == "" {
+			return fmt.Errorf("%w - unable to save record (no name)!", ErrMissingResource)
+		}
+		if err := checkResource(resource); err != nil {
+			return err
+		}
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+
+	if err := d.checkDelete(collection, false); err != nil {
+		return err
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	dir, err := d.collectionDir(collection)
+	if err != nil {
+		return err
+	}
+
+	// nothing may be created in dir until it has been replaced
+	_, err = d.fs.Stat(dir)
+	exists := err == nil
+	if exists {
+		unlock, err := d.lockSubcollections(collection)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	} else {
+		d.dirMu.Lock()
+		defer d.dirMu.Unlock()
+	}
+
+	fields, err := d.indexedFields(collection)
+	if err != nil {
+		return err
+	}
+
+	// names starting with '.' are never collections, so neither directory
+	// shows up while it exists
+	parent, base := filepath.Split(dir)
+	stage := filepath.Join(parent, "."+base+"-replace")
+	aside := filepath.Join(parent, "."+base+"-replaced")
+	for _, path := range []string{stage, aside} {
+		if err := d.fs.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	if err := d.fs.MkdirAll(stage, d.config(collection).dirPerm); err != nil {
+		return err
+	}
+
+	if err := d.fillStage(collection, stage, resources, items); err != nil {
+		d.fs.RemoveAll(stage)
+		return err
+	}
+
+	moved, err := d.carryOver(dir, stage)
+	if err != nil {
+		d.fs.RemoveAll(stage)
+		return err
+	}
+	restore := func() {
+		for _, name := range moved {
+			d.fs.Rename(filepath.Join(stage, name), filepath.Join(dir, name))
+		}
+		d.fs.RemoveAll(stage)
+	}
+
+	if exists {
+		if err := d.fs.Rename(dir, aside); err != nil {
+			restore()
+			return err
+		}
+	}
+	if err := d.fs.Rename(stage, dir); err != nil {
+		if exists {
+			d.fs.Rename(aside, dir)
+		}
+		restore()
+		return err
+	}
+	if exists {
+		if err := d.fs.RemoveAll(aside); err != nil {
+			d.logger().Warn("Unable to remove replaced records of %v: %v\n", collection, err)
+		}
+	}
+
+	if d.sync {
+		if err := d.fs.SyncDir(parent); err != nil {
+			return err
+		}
+	}
+
+	d.changed(OpWrite, collection, "")
+	for _, field := range fields {
+		if err := d.buildIndex(collection, field); err != nil {
+			return fmt.Errorf("unable to rebuild index %v of %v: %w", field, collection, err)
+		}
+	}
+	return nil
+}
+
+// fillStage writes the records for ReplaceCollection into the directory
+// they are staged in.
+func (d *Driver) fillStage(collection, stage string, resources []string, items map[string]interface{}) error {
+	cfg := d.config(collection)
+	for _, resource := range resources {
+		if err := d.validateRecord(collection, resource, items[resource]); err != nil {
+			return err
+		}
+
+		b, err := cfg.codec.Marshal(items[resource])
+		if err != nil {
+			return fmt.Errorf("unable to write %v: %w", resource, err)
+		}
+		if b, err = d.encode(b, cfg.compress); err != nil {
+			return fmt.Errorf("unable to write %v: %w", resource, err)
+		}
+
+		name := d.canonical(resource) + d.ext
+		if cfg.compress {
+			name += gzipExt
+		}
+		if err := d.fs.WriteFile(filepath.Join(stage, name), b, cfg.filePerm, d.sync); err != nil {
+			return fmt.Errorf("unable to write %v: %w", resource, err)
+		}
+	}
+	return nil
+}
+
+// carryOver moves what ReplaceCollection keeps, the nested collections and
+// the sequence file, from dir into stage and returns the names it moved. On
+// failure everything is moved back.
+func (d *Driver) carryOver(dir, stage string) ([]string, error) {
+	entries, err := d.fs.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var moved []string
+	for _, entry := range entries {
+		name := entry.Name()
+		keep := name == seqFile || (entry.IsDir() && !strings.HasPrefix(name, "."))
+		if !keep {
+			continue
+		}
+
+		if err := d.fs.Rename(filepath.Join(dir, name), filepath.Join(stage, name)); err != nil {
+			for _, name := range moved {
+				d.fs.Rename(filepath.Join(stage, name), filepath.Join(dir, name))
+			}
+			return nil, err
+		}
+		moved = append(moved, name)
+	}
+	return moved, nil
+}
+
+func (d *Driver) Read(collection, resource string, v interface{}) error {
+	return d.ReadContext(context.Background(), collection, resource, v)
+}
+
+// ReadContext is Read but gives up early once ctx is cancelled.
+func (d *Driver) ReadContext(ctx context.Context, collection, resource string, v interface{}) error {
+	b, err := d.readBytes(ctx, collection, resource)
+	if err != nil {
+		return err
+	}
+	return d.config(collection).codec.Unmarshal(b, v)
+}
+
+// ReadRaw returns a record exactly as the codec produced it, without
+// decoding it, so it can be passed on as is. Compression and encryption are
+// still undone.
+func (d *Driver) ReadRaw(collection, resource string) ([]byte, error) {
+	b, err := d.readBytes(context.Background(), collection, resource)
+	if err != nil {
+		return nil, err
+	}
+	if d.cache != nil {
+		// the cache keeps its own copy
+		b = append([]byte(nil), b...)
+	}
+	return b, nil
+}
+
+// readBytes returns a record's codec output, from the cache when it can.
+func (d *Driver) readBytes(ctx context.Context, collection, resource string) ([]byte, error) {
+	if err := d.validate(collection, resource); err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// expired records are removed once the read lock is released
+	var expired []string
+	defer func() { d.dropExpired(collection, expired) }()
+
+	unlock := d.lockRecord(collection, resource, false)
+	defer unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var b []byte
+	var err error
+	b, expired, err = d.readLocked(collection, resource)
+	return b, err
+}
+
+// readLocked is readBytes for a caller that already holds the record's
+// lock. A record found to have expired is returned in expired, for the
+// caller to drop once the lock is released.
+func (d *Driver) readLocked(collection, resource string) (b []byte, expired []string, err error) {
+	start := time.Now()
+
+	if d.cache != nil {
+		if b, ok := d.cache.get(cacheKey(collection, d.canonical(resource))); ok {
+			d.logger().Trace("Read %v/%v: %d bytes from cache in %v\n", collection, resource, len(b), time.Since(start))
+			return b, nil, nil
+		}
+	}
+
+	record, err := d.findRecord(collection, resource)
+	if err != nil {
+		if errors.Is(err, errExpired) {
+			expired = append(expired, resource)
+		}
+		return nil, expired, d.recordNotFound(collection, err)
+	}
+
+	b, err = d.readRecord(record)
+
+	if err != nil {
+		return nil, nil, d.recordNotFound(collection, err)
+	}
+
+	if d.cache != nil {
+		expires, err := d.expiry(collection, resource)
+		if err != nil {
+			return nil, nil, err
+		}
+		d.cache.put(cacheKey(collection, d.canonical(resource)), b, expires)
+	}
+
+	d.logger().Trace("Read %v/%v: %d bytes in %v\n", collection, resource, len(b), time.Since(start))
+	return b, nil, nil
+}
+
+// ReadTyped reads a record and returns it decoded as a T.
+func ReadTyped[T any](d *Driver, collection, resource string) (T, error) {
+	var v T
+	if err := d.Read(collection, resource, &v); err != nil {
+		var zero T
+		return zero, err
+	}
+	return v, nil
+}
+
+// ReadOrDefault is ReadTyped but returns def when the record doesn't exist.
+// Any other error, such as a record that can't be decoded, is still
+// returned.
+func ReadOrDefault[T any](d *Driver, collection, resource string, def T) (T, error) {
+	v, err := ReadTyped[T](d, collection, resource)
+	if errors.Is(err, ErrNotFound) {
+		return def, nil
+	}
+	return v, err
+}
+
+// ReadFields copies only the named fields of a record into dst, keyed by the
+// names as given. A field may reach into nested objects with dots, as in
+// "Address.City"; fields the record lacks are left out of dst.
+func (d *Driver) ReadFields(collection, resource string, fields []string, dst map[string]interface{}) error {
+	b, err := d.readBytes(context.Background(), collection, resource)
+	if err != nil {
+		return err
+	}
+
+	record := map[string]interface{}{}
+	if err := d.decodeFields(collection, b, &record); err != nil {
+		return fmt.Errorf("unable to decode %s: %w", resource, err)
+	}
+
+	for _, field := range fields {
+		if v, ok := lookupField(record, strings.Split(field, ".")); ok {
+			dst[field] = v
+		}
+	}
+	return nil
+}
+
+// ReadIfModifiedSince decodes a record into v only if its file was modified
+// after t, and reports whether it was. An unchanged record is neither read
+// nor decoded, which suits answering HTTP conditional requests.
+func (d *Driver) ReadIfModifiedSince(collection, resource string, t time.Time, v interface{}) (bool, error) {
+	if err := d.validate(collection, resource); err != nil {
+		return false, err
+	}
+
+	unlock := d.lockRecord(collection, resource, false)
+	defer unlock()
+
+	path, fi, err := d.statRecord(collection, resource)
+	if err != nil {
+		return false, err
+	}
+	if !fi.ModTime().After(t) {
+		return false, nil
+	}
+
+	b, err := d.readRecord(path)
+	if err != nil {
+		return false, d.recordNotFound(collection, err)
+	}
+	return true, d.config(collection).codec.Unmarshal(b, v)
+}
+
+// ModTime returns when a record was last written.
+func (d *Driver) ModTime(collection, resource string) (time.Time, error) {
+	_, modTime, err := d.ReadMeta(collection, resource, nil)
+	return modTime, err
+}
+
+// Size returns the size of a record's file on disk, after any compression
+// and encryption, without reading it.
+func (d *Driver) Size(collection, resource string) (int64, error) {
+	size, _, err := d.ReadMeta(collection, resource, nil)
+	return size, err
+}
+
+// ReadMeta decodes a record into v, as Read does, and also returns the size
+// of its file on disk and when it was last written. With a nil v only the
+// metadata is returned and the record isn't read.
+func (d *Driver) ReadMeta(collection, resource string, v interface{}) (int64, time.Time, error) {
+	if err := d.validate(collection, resource); err != nil {
+		return 0, time.Time{}, err
+	}
+
+	unlock := d.lockRecord(collection, resource, false)
+	defer unlock()
+
+	path, fi, err := d.statRecord(collection, resource)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	if v != nil {
+		b, err := d.readRecord(path)
+		if err != nil {
+			return 0, time.Time{}, d.recordNotFound(collection, err)
+		}
+		if err := d.config(collection).codec.Unmarshal(b, v); err != nil {
+			return 0, time.Time{}, err
+		}
+	}
+	return fi.Size(), fi.ModTime(), nil
+}
+
+// statRecord finds a record's file and stats it. The caller must hold the
+// record's lock.
+func (d *Driver) statRecord(collection, resource string) (string, fs.FileInfo, error) {
+	path, err := d.findRecord(collection, resource)
+	if err != nil {
+		return "", nil, d.recordNotFound(collection, err)
+	}
+
+	fi, err := d.fs.Stat(path)
+	if err != nil {
+		return "", nil, d.recordNotFound(collection, err)
+	}
+	return path, fi, nil
+}
+
+// Exists reports whether a record is present without decoding it.
+func (d *Driver) Exists(collection, resource string) (bool, error) {
+	if err := d.validate(collection, resource); err != nil {
+		return false, err
+	}
+
+	unlock := d.lockRecord(collection, resource, false)
+	defer unlock()
+
+	if _, err := d.findRecord(collection, resource); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (d *Driver) ReadAll(collection string) ([]string, error) {
+	return d.ReadAllContext(context.Background(), collection)
+}
+
+// ReadAllContext is ReadAll but checks ctx between records, so a large
+// collection can be abandoned part way through.
+func (d *Driver) ReadAllContext(ctx context.Context, collection string) ([]string, error) {
+	if err := d.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	var records []string
+	var n int
+
+	err := d.each(ctx, collection, func(resource string, raw []byte) error {
+		records = append(records, string(raw))
+		n += len(raw)
+		return nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	d.logger().Trace("Read %d records from %v: %d bytes in %v\n", len(records), collection, n, time.Since(start))
+	return records, nil
+}
+
+// ReadAllMap is ReadAll keyed by resource name, so each record can be told
+// apart.
+func (d *Driver) ReadAllMap(collection string) (map[string][]byte, error) {
+	records := make(map[string][]byte)
+	err := d.each(context.Background(), collection, func(resource string, raw []byte) error {
+		records[resource] = raw
+		return nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Keys returns the names of the records in a collection, in name order,
+// without reading the records themselves, which makes it much cheaper than
+// ReadAllMap when only the names are wanted. Temp files, expired records
+// and nested collections are left out.
+func (d *Driver) Keys(collection string) ([]string, error) {
+	if err := d.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	if collection == "" {
+		return nil, fmt.Errorf("%w - unable to list records", ErrMissingCollection)
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return nil, err
+	}
+
+	var expired []string
+	defer func() { d.dropExpired(collection, expired) }()
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	files, expired, err := d.recordFiles(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, len(files))
+	for i, file := range files {
+		keys[i], _ = d.resourceName(file)
+	}
+	return keys, nil
+}
+
+// RecordError reports a record that could not be read or decoded.
+type RecordError struct {
+	Collection string
+	Resource   string
+	Err        error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("record %v/%v: %v", e.Collection, e.Resource, e.Err)
+}
+
+func (e *RecordError) Unwrap() error { return e.Err }
+
+// ReadAllLenient is ReadAll for collections that may hold damaged files: a
+// record that can't be read or decoded is logged and skipped instead of
+// failing the call, and reported as a *RecordError alongside the records
+// that were fine. The error result is only set when the collection itself
+// can't be read.
+func (d *Driver) ReadAllLenient(collection string) ([]string, []error, error) {
+	var records []string
+	var problems []error
+
+	skip := func(resource string, err error) {
+		d.logger().Warn("Skipping unreadable record %v/%v: %v\n", collection, resource, err)
+		problems = append(problems, &RecordError{Collection: collection, Resource: resource, Err: err})
+	}
+
+	codec := d.config(collection).codec
+	err := d.each(context.Background(), collection, func(resource string, raw []byte) error {
+		var v interface{}
+		if err := codec.Unmarshal(raw, &v); err != nil {
+			skip(resource, err)
+			return nil
+		}
+		records = append(records, string(raw))
+		return nil
+	}, skip)
+	if err != nil {
+		return nil, nil, err
+	}
+	return records, problems, nil
+}
+
+// ReadAllInto decodes every record in a collection into a slice of T.
+func ReadAllInto[T any](d *Driver, collection string) ([]T, error) {
+	return Filter(d, collection, func(T) bool { return true })
+}
+
+// ReadAllSorted is ReadAllInto with the records ordered by less. Records that
+// compare equal stay in name order. The whole collection is decoded into
+// memory before sorting, so prefer Iterate for very large collections.
+func ReadAllSorted[T any](d *Driver, collection string, less func(a, b T) bool) ([]T, error) {
+	records, err := ReadAllInto[T](d, collection)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(records, func(i, j int) bool { return less(records[i], records[j]) })
+	return records, nil
+}
+
+// Filter decodes the records in a collection one at a time and returns those
+// for which pred is true.
+func Filter[T any](d *Driver, collection string, pred func(T) bool) ([]T, error) {
+	records := []T{}
+
+	codec := d.config(collection).codec
+	err := d.each(context.Background(), collection, func(resource string, raw []byte) error {
+		var record T
+		if err := codec.Unmarshal(raw, &record); err != nil {
+			return fmt.Errorf("unable to decode %s: %w", resource, err)
+		}
+		if pred(record) {
+			records = append(records, record)
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// SelectOptions shapes the result of Select. Every field is optional.
+type SelectOptions[T any] struct {
+	// Where keeps only the records it returns true for.
+	Where func(T) bool
+	// Less orders the records; without it they come in name order.
+	Less func(a, b T) bool
+	// Offset skips that many records of the result, and Limit, when
+	// positive, caps how many are returned.
+	Offset int
+	Limit  int
+}
+
+// errEnough stops a walk once Select has every record it needs.
+var errEnough = errors.New("enough records")
+
+// Select finds, orders and pages the records of a collection in one call.
+// Records are decoded one at a time and only those passing Where are kept.
+// Without Less, the walk stops as soon as the page is full.
+func Select[T any](d *Driver, collection string, opts SelectOptions[T]) ([]T, error) {
+	if opts.Offset < 0 || opts.Limit < 0 {
+		return nil, fmt.Errorf("invalid page of %v: offset %d, limit %d", collection, opts.Offset, opts.Limit)
+	}
+
+	records := []T{}
+	codec := d.config(collection).codec
+	err := d.each(context.Background(), collection, func(resource string, raw []byte) error {
+		var record T
+		if err := codec.Unmarshal(raw, &record); err != nil {
+			return fmt.Errorf("unable to decode %s: %w", resource, err)
+		}
+		if opts.Where != nil && !opts.Where(record) {
+			return nil
+		}
+		records = append(records, record)
+
+		if opts.Less == nil && opts.Limit > 0 && len(records) == opts.Offset+opts.Limit {
+			return errEnough
+		}
+		return nil
+	}, nil)
+	if err != nil && err != errEnough {
+		return nil, err
+	}
+
+	if opts.Less != nil {
+		sort.SliceStable(records, func(i, j int) bool { return opts.Less(records[i], records[j]) })
+	}
+
+	if opts.Offset >= len(records) {
+		return []T{}, nil
+	}
+	records = records[opts.Offset:]
+	if opts.Limit > 0 && opts.Limit < len(records) {
+		records = records[:opts.Limit]
+	}
+	return records, nil
+}
+
+// DeleteWhere deletes every record in a collection for which pred is true
+// and returns how many it deleted. The collection is locked throughout, and
+// all matches are found before any is deleted. With SoftDelete set the
+// records go to the trash.
+func DeleteWhere[T any](d *Driver, collection string, pred func(T) bool) (int, error) {
+	if err := d.checkOpen(); err != nil {
+		return 0, err
+	}
+
+	if collection == "" {
+		return 0, fmt.Errorf("%w - unable to delete records!", ErrMissingCollection)
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return 0, err
+	}
+
+	if err := d.checkDelete(collection, false); err != nil {
+		return 0, err
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	files, _, err := d.recordFiles(collection)
+	if err != nil {
+		return 0, err
+	}
+
+	var matches []string
+	codec := d.config(collection).codec
+	for _, file := range files {
+		resource, _ := d.resourceName(file)
+
+		b, err := d.readRecord(filepath.Join(d.dir, collection, file))
+		if err != nil {
+			return 0, err
+		}
+		var record T
+		if err := codec.Unmarshal(b, &record); err != nil {
+			return 0, fmt.Errorf("unable to decode %s: %w", resource, err)
+		}
+		if pred(record) {
+			matches = append(matches, resource)
+		}
+	}
+
+	if d.dryRun {
+		d.wouldDelete(collection, matches)
+		return len(matches), nil
+	}
+
+	for i, resource := range matches {
+		if d.softDelete {
+			err = d.trashRecord(collection, resource)
+		} else {
+			err = d.removeRecord(collection, resource)
+		}
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(matches), nil
+}
+
+// Truncate deletes every record in a collection, expired ones included, and
+// returns how many it removed. Unlike DropCollection it leaves the
+// collection itself in place, along with its schema, indexes and nested
+// collections.
+func (d *Driver) Truncate(collection string) (int, error) {
+	if err := d.checkOpen(); err != nil {
+		return 0, err
+	}
+
+	if collection == "" {
+		return 0, fmt.Errorf("%w - unable to truncate!", ErrMissingCollection)
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return 0, err
+	}
+
+	if err := d.checkDelete(collection, false); err != nil {
+		return 0, err
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	files, expired, err := d.recordFiles(collection)
+	if err != nil {
+		return 0, err
+	}
+
+	resources := expired
+	for _, file := range files {
+		resource, _ := d.resourceName(file)
+		resources = append(resources, resource)
+	}
+
+	if d.dryRun {
+		d.wouldDelete(collection, resources)
+		return len(resources), nil
+	}
+
+	for i, resource := range resources {
+		if d.softDelete {
+			err = d.trashRecord(collection, resource)
+		} else {
+			err = d.removeRecord(collection, resource)
+		}
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(resources), nil
+}
+
+// Iterate calls fn with the name and raw contents of each record in a
+// collection, one file at a time, so memory use stays flat however large the
+// collection is. Iteration stops at the first error fn returns, which is
+// passed back to the caller.
+func (d *Driver) Iterate(collection string, fn func(resource string, raw []byte) error) error {
+	return d.each(context.Background(), collection, fn, nil)
+}
+
+// each calls fn with the name and contents of every record in a collection,
+// in name order, while holding the collection's read lock. It stops at the
+// first error fn returns. A record that can't be read is passed to bad and
+// skipped, or stops the walk when bad is nil.
+func (d *Driver) each(ctx context.Context, collection string, fn func(resource string, raw []byte) error, bad func(resource string, err error)) error {
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+
+	if collection == "" {
+		return fmt.Errorf("%w - unable to read", ErrMissingCollection)
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var expired []string
+	defer func() { d.dropExpired(collection, expired) }()
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	dir := filepath.Join(d.dir, collection)
+
+	files, expired, err := d.recordFiles(collection)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		resource, _ := d.resourceName(file)
+
+		b, err := d.readRecord(filepath.Join(dir, file))
+		if err != nil {
+			if bad == nil {
+				return err
+			}
+			bad(resource, err)
+			continue
+		}
+
+		if err := fn(resource, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadPage returns up to limit records starting at offset, ordered by
+// resource name. Pages past the end are empty.
+func (d *Driver) ReadPage(collection string, offset, limit int) ([]string, error) {
+	if err := d.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	if collection == "" {
+		return nil, fmt.Errorf("%w - unable to read", ErrMissingCollection)
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return nil, err
+	}
+
+	if offset < 0 || limit < 0 {
+		return nil, fmt.Errorf("invalid page: offset %d, limit %d", offset, limit)
+	}
+
+	var expired []string
+	defer func() { d.dropExpired(collection, expired) }()
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	dir := filepath.Join(d.dir, collection)
+
+	files, expired, err := d.recordFiles(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []string{}
+	if offset >= len(files) {
+		return records, nil
+	}
+
+	files = files[offset:]
+	if len(files) > limit {
+		files = files[:limit]
+	}
+
+	for _, file := range files {
+		b, err := d.readRecord(filepath.Join(dir, file))
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, string(b))
+	}
+	return records, nil
+}
+
+// ReadAfter returns up to limit records whose resource names sort after
+// after, in name order, along with their names. Pass "" to start at the
+// beginning and the last name returned to get the next page; unlike
+// ReadPage's offsets, that cursor doesn't shift when records before it are
+// written or deleted between calls. Past the end both slices are empty.
+func (d *Driver) ReadAfter(collection, after string, limit int) ([]string, []string, error) {
+	if err := d.checkOpen(); err != nil {
+		return nil, nil, err
+	}
+
+	if collection == "" {
+		return nil, nil, fmt.Errorf("%w - unable to read", ErrMissingCollection)
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return nil, nil, err
+	}
+
+	if limit < 0 {
+		return nil, nil, fmt.Errorf("invalid page: limit %d", limit)
+	}
+
+	var expired []string
+	defer func() { d.dropExpired(collection, expired) }()
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	dir := filepath.Join(d.dir, collection)
+
+	files, expired, err := d.recordFiles(collection)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// file names sort differently from resource names once the extension
+	// is on, so order by the names themselves
+	resources := make(map[string]string, len(files))
+	names := []string{}
+	after = d.canonical(after)
+	for _, file := range files {
+		resource, _ := d.resourceName(file)
+		if resource > after {
+			resources[resource] = file
+			names = append(names, resource)
+		}
+	}
+	sort.Strings(names)
+	if len(names) > limit {
+		names = names[:limit]
+	}
+
+	records := make([]string, len(names))
+	for i, resource := range names {
+		b, err := d.readRecord(filepath.Join(dir, resources[resource]))
+		if err != nil {
+			return nil, nil, err
+		}
+		records[i] = string(b)
+	}
+	return records, names, nil
+}
+
+// recordFiles lists the file names of the live records in a collection,
+// sorted, along with the resources it skipped because they have expired.
+// The caller must hold the collection's lock.
+func (d *Driver) recordFiles(collection string) (names, expired []string, err error) {
+	dir, err := d.collectionDir(collection)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := d.fs.Stat(dir); err != nil {
+		return nil, nil, notFound(err)
+	}
+
+	files, err := d.fs.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ttls := make(map[string]bool)
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ttlExt) {
+			ttls[strings.TrimSuffix(file.Name(), ttlExt)] = true
+		}
+	}
+
+	for _, file := range files {
+		if !d.isRecord(file) {
+			continue
+		}
+
+		resource, _ := d.resourceName(file.Name())
+		if ttls[resource] {
+			gone, err := d.isExpired(collection, resource)
+			if err != nil {
+				return nil, nil, err
+			}
+			if gone {
+				expired = append(expired, resource)
+				continue
+			}
+		}
+		names = append(names, file.Name())
+	}
+	return names, expired, nil
+}
+
+// Count returns the number of records in a collection.
+func (d *Driver) Count(collection string) (int, error) {
+	if err := d.checkOpen(); err != nil {
+		return 0, err
+	}
+
+	if collection == "" {
+		return 0, fmt.Errorf("%w - unable to count", ErrMissingCollection)
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return 0, err
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	files, _, err := d.recordFiles(collection)
+	if err != nil {
+		return 0, err
+	}
+	return len(files), nil
+}
+
+// Delete removes a record. An empty resource fails with ErrMissingResource;
+// use DropCollection to remove a whole collection.
+// With SoftDelete set the record goes to the trash instead.
+func (d *Driver) Delete(collection, resource string) error {
+	return d.DeleteContext(context.Background(), collection, resource)
+}
+
+// DeleteContext is Delete but gives up early once ctx is cancelled.
+func (d *Driver) DeleteContext(ctx context.Context, collection, resource string) error {
+	if err := d.validate(collection, resource); err != nil {
+		if resource == "" && errors.Is(err, ErrMissingResource) {
+			return fmt.Errorf("%w, use DropCollection to delete a collection", err)
+		}
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := d.checkDelete(collection, false); err != nil {
+		return err
+	}
+
+	unlock := d.lockRecord(collection, resource, true)
+	defer unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+
+	if _, err := d.findRecord(collection, resource); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if errors.Is(err, errExpired) && !d.dryRun {
+			// it is gone as far as callers can tell; finish the job
+			if err := d.removeRecord(collection, resource); err != nil {
+				return err
+			}
+		}
+		return d.recordNotFound(collection, fmt.Errorf("unable to find record %v/%v: %w", collection, resource, os.ErrNotExist))
+	}
+
+	if d.dryRun {
+		d.wouldDelete(collection, []string{resource})
+		return nil
+	}
+
+	var err error
+	if d.softDelete {
+		err = d.trashRecord(collection, resource)
+	} else {
+		err = d.removeRecord(collection, resource)
+	}
+	if err != nil {
+		return err
+	}
+
+	d.logger().Trace("Deleted %v/%v in %v\n", collection, resource, time.Since(start))
+	return nil
 }
 
-func New(dir string, options *Options) (*Driver, error) {
-	dir = filepath.Clean(dir)
-	opts := Options{}
-	if options != nil {
-		opts = *options
+// deleteCollection removes, or trashes, a whole collection. The caller must
+// hold its lock.
+func (d *Driver) deleteCollection(collection string) error {
+	dir, err := d.collectionDir(collection)
+	if err != nil {
+		return err
 	}
-	if opts.Logger == nil {
-		opts.Logger = lumber.NewConsoleLogger((lumber.INFO))
+
+	fi, err := d.fs.Stat(dir)
+	if err != nil || !fi.IsDir() {
+		return fmt.Errorf("%w: unable to find collection %v", ErrCollectionNotFound, collection)
 	}
 
-	driver := Driver{
-		dir: dir,
-		mutexes: make(map[string]*sync.Mutex),
-		log: opts.Logger,
+	unlock, err := d.lockSubcollections(collection)
+	if err != nil {
+		return err
 	}
+	defer unlock()
 
-	if _,err := os.Stat(dir); err == nil {
-		opts.Logger.Debug("Using '%s' (database already exists)\n", dir)
-		return &driver, nil
+	if d.dryRun {
+		subs, err := d.subcollections(collection)
+		if err != nil {
+			return err
+		}
+		for _, sub := range append([]string{collection}, subs...) {
+			d.logger().Info("Dry run: would delete collection %v\n", sub)
+		}
+		return nil
+	}
+
+	if d.softDelete {
+		err = d.trashTree(collection)
+	} else {
+		err = d.fs.RemoveAll(dir)
+	}
+	if err != nil {
+		return err
+	}
+
+	d.changed(OpDelete, collection, "")
+	return nil
+}
+
+// Collections lists the collections in the database in name order. Nested
+// collections are included by their full name, as in "users/active".
+func (d *Driver) Collections() ([]string, error) {
+	if err := d.checkOpen(); err != nil {
+		return nil, err
 	}
 
-	opts.Logger.Debug("Creating database at '%s'...\n",dir)
-	return &driver, os.MkdirAll(dir,0755)
+	collections, err := d.subcollections("")
+	if err != nil {
+		return nil, err
+	}
+	return collections, nil
 }
 
-func (d *Driver) Write(collection, resource string, v interface{}) error {
-	if collection == ""{
-		return fmt.Errorf("Missing collection - no place to save record!")
+// subcollections lists, sorted, every collection nested under collection,
+// or every collection at all when it is empty.
+func (d *Driver) subcollections(collection string) ([]string, error) {
+	root, err := d.collectionDir(collection)
+	if err != nil {
+		return nil, err
 	}
 
-	if resource == "" {
-		return fmt.Errorf("Missing resource - unable to save record (no name)!")
+	collections := []string{}
+	err = d.walk(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root || !entry.IsDir() {
+			return nil
+		}
+		// dot directories such as the trash are internal
+		if strings.HasPrefix(entry.Name(), ".") {
+			return filepath.SkipDir
+		}
+
+		rel, err := filepath.Rel(d.dir, path)
+		if err != nil {
+			return err
+		}
+		collections = append(collections, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	mutex := d.getOrCreateMutex(collection)
-	mutex.Lock()
-	defer mutex.Unlock()
+	sort.Strings(collections)
+	return collections, nil
+}
 
-	dir := filepath.Join(d.dir, collection)
-	fnlPath := filepath.Join(dir, resource+".json")
-	tmpPath := fnlPath + ".tmp"
+// lockSubcollections write-locks every collection nested under collection,
+// whose own lock the caller must already hold, and returns a func that
+// releases them. Together they cover everything a removal of collection
+// touches. It returns holding dirMu too, so no collection can be created
+// under collection until the func is called.
+func (d *Driver) lockSubcollections(collection string) (func(), error) {
+	for {
+		collections, err := d.subcollections(collection)
+		if err != nil {
+			return nil, err
+		}
+
+		// they all sort after collection, keeping locks in name order
+		locks := make([]*collectionLock, len(collections))
+		for i, sub := range collections {
+			locks[i] = d.getOrCreateMutex(sub)
+			locks[i].Lock()
+		}
+		unlock := func() {
+			d.dirMu.Unlock()
+			for _, lock := range locks {
+				lock.Unlock()
+			}
+		}
 
-	if err := os.MkdirAll(dir, 0755); err != nil {
+		// a collection created while they were being locked isn't covered;
+		// start over, as locking it now would break name order
+		d.dirMu.Lock()
+		now, err := d.subcollections(collection)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		if strings.Join(now, "\x00") == strings.Join(collections, "\x00") {
+			return unlock, nil
+		}
+		unlock()
+	}
+}
+
+// DropCollection removes a collection and every record in it, along with
+// any collections nested inside it. With SoftDelete set they all go to the
+// trash instead.
+func (d *Driver) DropCollection(collection string) error {
+	if err := d.checkOpen(); err != nil {
 		return err
 	}
 
-	b, err := json.MarshalIndent(v,"","\t")
-	if err != nil {
+	if collection == "" {
+		return fmt.Errorf("%w - unable to drop collection!", ErrMissingCollection)
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	if err := d.checkDelete(collection, true); err != nil {
 		return err
 	}
 
-	b = append(b, byte('\n'))
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
 
-	if err := os.WriteFile(tmpPath, b, 0644); err != nil {
+	start := time.Now()
+	if err := d.deleteCollection(collection); err != nil {
 		return err
 	}
+	d.logger().Trace("Deleted collection %v in %v\n", collection, time.Since(start))
+	return nil
+}
 
-	return os.Rename(tmpPath, fnlPath)
+// collectionLock guards one collection, or one record in it. Every
+// getOrCreateMutex must be paired with exactly one Unlock or RUnlock, or be
+// handed to releaseMutex; the lock leaves the driver's table when its last
+// user is done with it, so the table only ever holds what is in use.
+//
+// A collection's lock has three modes. Lock takes the whole collection for
+// operations that change more than one record. RLock gives a consistent view
+// of every record, shutting out writers but not readers of single records
+// or other scans. lockRecord shares the collection with other single-record
+// operations and locks just the record, so writes to different records in a
+// collection run side by side.
+type collectionLock struct {
+	mu         sync.RWMutex // whole-collection operations against the rest
+	scan       scanLock     // scans against single-record writes
+	d          *Driver
+	collection string
+	refs       int
 }
 
-func (d *Driver) Read(collection, resource string, v interface{}) error {
+func (l *collectionLock) Lock() {
+	l.mu.Lock()
+}
+
+func (l *collectionLock) Unlock() {
+	l.mu.Unlock()
+	l.d.releaseMutex(l)
+}
+
+func (l *collectionLock) RLock() {
+	l.mu.RLock()
+	l.scan.lock(scanning)
+}
+
+func (l *collectionLock) RUnlock() {
+	l.scan.unlock(scanning)
+	l.mu.RUnlock()
+	l.d.releaseMutex(l)
+}
+
+// The sides of a scanLock.
+const (
+	scanning = iota
+	writing
+)
+
+// scanLock keeps the scans of a collection apart from writes to its single
+// records while letting any number of either in at once: scans share it
+// with scans and writes with writes, never one with the other. Once one
+// side is waiting, newcomers of the other queue behind it, so a steady
+// stream of either can't starve the other.
+type scanLock struct {
+	mu      sync.Mutex
+	cond    sync.Cond
+	held    [2]int
+	waiting [2]int
+}
+
+func (l *scanLock) blocked(side int) bool {
+	other := 1 - side
+	return l.held[other] > 0 || l.waiting[other] > 0 && l.held[side] > 0
+}
+
+func (l *scanLock) lock(side int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.cond.L == nil {
+		l.cond.L = &l.mu
+	}
+	l.waiting[side]++
+	for l.blocked(side) {
+		l.cond.Wait()
+	}
+	l.waiting[side]--
+	l.held[side]++
+}
+
+func (l *scanLock) tryLock(side int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.blocked(side) {
+		return false
+	}
+	l.held[side]++
+	return true
+}
+
+func (l *scanLock) unlock(side int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.held[side]--
+	if l.held[side] == 0 && l.cond.L != nil {
+		l.cond.Broadcast()
+	}
+}
+
+// lockRecord locks one record, for writing or for reading, and returns the
+// func that unlocks it.
+func (d *Driver) lockRecord(collection, resource string, write bool) func() {
+	coll := d.getOrCreateMutex(collection)
+	rec := d.getOrCreateMutex(recordKey(collection, d.canonical(resource)))
+
+	coll.mu.RLock()
+	if write {
+		coll.scan.lock(writing)
+		rec.mu.Lock()
+	} else {
+		rec.mu.RLock()
+	}
+
+	return d.recordUnlocker(coll, rec, write)
+}
+
+// tryLockRecord is lockRecord, but gives up rather than wait if anything is
+// in the way.
+func (d *Driver) tryLockRecord(collection, resource string, write bool) (func(), bool) {
+	coll := d.getOrCreateMutex(collection)
+	rec := d.getOrCreateMutex(recordKey(collection, d.canonical(resource)))
+
+	giveUp := func() (func(), bool) {
+		d.releaseMutex(rec)
+		d.releaseMutex(coll)
+		return nil, false
+	}
+
+	if !coll.mu.TryRLock() {
+		return giveUp()
+	}
+	if write {
+		if !coll.scan.tryLock(writing) {
+			coll.mu.RUnlock()
+			return giveUp()
+		}
+		if !rec.mu.TryLock() {
+			coll.scan.unlock(writing)
+			coll.mu.RUnlock()
+			return giveUp()
+		}
+	} else if !rec.mu.TryRLock() {
+		coll.mu.RUnlock()
+		return giveUp()
+	}
+
+	return d.recordUnlocker(coll, rec, write), true
+}
+
+// recordKey names a record's lock. NUL can't appear in names, so record keys
+// never clash with collections.
+func recordKey(collection, resource string) string {
+	return collection + "\x00" + resource
+}
+
+func (d *Driver) recordUnlocker(coll, rec *collectionLock, write bool) func() {
+	return func() {
+		if write {
+			rec.mu.Unlock()
+			coll.scan.unlock(writing)
+		} else {
+			rec.mu.RUnlock()
+		}
+		coll.mu.RUnlock()
+
+		d.releaseMutex(rec)
+		d.releaseMutex(coll)
+	}
+}
+
+func (d *Driver) getOrCreateMutex(collection string) *collectionLock {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	m, ok := d.mutexes[collection]
+	if !ok {
+		m = &collectionLock{d: d, collection: collection}
+		d.mutexes[collection]=m
+	}
+	m.refs++
+	return m
+}
+
+func (d *Driver) releaseMutex(l *collectionLock) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	l.refs--
+	if l.refs == 0 {
+		delete(d.mutexes, l.collection)
+	}
+}
+
+// changed is called after every successful change to a record, or with an
+// empty resource after a whole collection is removed.
+func (d *Driver) changed(op Op, collection, resource string) {
+	resource = d.canonical(resource)
+	if d.cache != nil {
+		if resource == "" {
+			d.cache.removePrefix(cacheKey(collection, ""))
+		} else {
+			d.cache.remove(cacheKey(collection, resource))
+		}
+	}
+
+	d.updateIndexes(op, collection, resource)
+	d.notify(op, collection, resource)
+}
+
+// validate checks that the database is open and that collection and
+// resource name a record, as every call on a single record needs.
+func (d *Driver) validate(collection, resource string) error {
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+
 	if collection == "" {
-		return fmt.Errorf("Missing collection - unable to read record!")
+		return fmt.Errorf("%w - unable to locate record (no collection)!", ErrMissingCollection)
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return err
 	}
 
 	if resource == "" {
-		return fmt.Errorf("Missing resource - unable to read record (no name)!")
+		return fmt.Errorf("%w - unable to locate record (no name)!", ErrMissingResource)
+	}
+
+	return checkResource(resource)
+}
+
+// checkCollection rejects collection names that would resolve outside the
+// database directory or clash with its internal dot directories.
+func checkCollection(collection string) error {
+	// nested collections are written with '/', as in "users/active"
+	for _, part := range strings.Split(collection, "/") {
+		if blank(part) {
+			return fmt.Errorf("%w: %w: collection %q (empty or blank level)", ErrMissingCollection, ErrInvalidName, collection)
+		}
+		if strings.HasPrefix(part, ".") {
+			return fmt.Errorf("%w: collection %q (names starting with '.' are reserved)", ErrInvalidName, collection)
+		}
+		if checkName("collection", part) != nil {
+			return fmt.Errorf("%w: collection %q", ErrInvalidName, collection)
+		}
+	}
+	return nil
+}
+
+// checkResource rejects resource names that would resolve outside their
+// collection, and blank ones, or ones ending in a separator, which name a
+// directory rather than a record. An empty name is left to the caller,
+// since some calls give it a meaning of their own.
+func checkResource(resource string) error {
+	if resource != "" && blank(resource) {
+		return fmt.Errorf("%w: %w: resource %q (empty or blank)", ErrMissingResource, ErrInvalidName, resource)
+	}
+	if strings.HasSuffix(resource, "/") || strings.HasSuffix(resource, "\\") {
+		return fmt.Errorf("%w: %w: resource %q (no name after the last separator)", ErrMissingResource, ErrInvalidName, resource)
+	}
+	return checkName("resource", resource)
+}
+
+// blank reports whether a name is nothing but whitespace and path
+// separators, which would leave no file name once cleaned.
+func blank(name string) bool {
+	return strings.TrimFunc(name, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '/' || r == '\\'
+	}) == ""
+}
+
+func checkName(kind, name string) error {
+	if name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return fmt.Errorf("%w: %v %q", ErrInvalidName, kind, name)
+	}
+	return nil
+}
+
+// confine makes sure path, with any symbolic links in it followed, stays
+// inside the database, so a planted link can't redirect a read or write
+// elsewhere. A path that doesn't exist yet is judged by its nearest
+// existing parent.
+func (d *Driver) confine(path string) error {
+	if !isWithin(d.dir, path) {
+		return fmt.Errorf("%w: %v is outside the database", ErrInvalidName, path)
 	}
 
-	record := filepath.Join(d.dir, collection, resource)
+	r, ok := d.fs.(resolver)
+	if !ok {
+		return nil
+	}
 
-	if _, err := stat(record); err != nil {
-		return err;
+	for p := path; ; p = filepath.Dir(p) {
+		resolved, err := r.EvalSymlinks(p)
+		if err == nil {
+			if !isWithin(d.root, resolved) {
+				return fmt.Errorf("%w: %v resolves to %v, outside the database", ErrInvalidName, path, resolved)
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) || p == filepath.Dir(p) {
+			return err
+		}
 	}
+}
 
-	b, err := os.ReadFile(record+".json")
+// collectionDir returns a collection's directory, confined to the
+// database, so a collection that is a planted link to a directory elsewhere
+// is refused rather than listed or changed.
+func (d *Driver) collectionDir(collection string) (string, error) {
+	dir := filepath.Join(d.dir, collection)
+	if err := d.confine(dir); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
 
+// isWithin reports whether path is root or lies below it.
+func isWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
 	if err != nil {
-		return err
+		return false
 	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// notFoundError is the type of ErrCollectionNotFound and
+// ErrResourceNotFound.
+type notFoundError string
+
+func (e notFoundError) Error() string { return string(e) + " not found" }
 
-	return json.Unmarshal(b, &v)
+func (e notFoundError) Is(target error) bool {
+	return target == ErrNotFound || target == fs.ErrNotExist
 }
 
-func (d *Driver) ReadAll(collection string) ([]string, error) {
-	if collection == "" {
-		return nil, fmt.Errorf("Missing collection - unable to read")
+// notFound tags a missing collection directory with ErrCollectionNotFound
+// so callers can use errors.Is.
+func notFound(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %w", ErrCollectionNotFound, err)
 	}
-	dir := filepath.Join(d.dir, collection)
+	return err
+}
 
-	if _, err := stat(dir); err != nil {
-		return nil, err
+// recordNotFound tags a missing record with ErrResourceNotFound, or with
+// ErrCollectionNotFound when its whole collection is missing.
+func (d *Driver) recordNotFound(collection string, err error) error {
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
 	}
+	if fi, serr := d.fs.Stat(filepath.Join(d.dir, collection)); serr != nil || !fi.IsDir() {
+		return fmt.Errorf("%w: %w", ErrCollectionNotFound, err)
+	}
+	return fmt.Errorf("%w: %w", ErrResourceNotFound, err)
+}
 
-	files, _ := os.ReadDir(dir)
+// recordPath is where a record is written under the current settings.
+func (d *Driver) recordPath(collection, resource string) string {
+	path := filepath.Join(d.dir, collection, d.canonical(resource)+d.ext)
+	if d.config(collection).compress {
+		path += gzipExt
+	}
+	return path
+}
 
-	var records []string
+// findRecord returns the path of a stored record, whether or not it is
+// compressed, or a not-exist error if there is none.
+func (d *Driver) findRecord(collection, resource string) (string, error) {
+	path := filepath.Join(d.dir, collection, d.canonical(resource)+d.ext)
+	candidates := []string{path, path + gzipExt}
+	if d.config(collection).compress {
+		candidates[0], candidates[1] = candidates[1], candidates[0]
+	}
 
-	for _, file := range files {
-		b, err := os.ReadFile(filepath.Join(dir, file.Name()))
-		if err != nil {
+	var err error
+	for _, candidate := range candidates {
+		var fi os.FileInfo
+		if fi, err = d.fs.Stat(candidate); err == nil && fi.Mode().IsRegular() {
+			if err := d.confine(candidate); err != nil {
+				return "", err
+			}
+			expired, err := d.isExpired(collection, resource)
+			if err != nil {
+				return "", err
+			}
+			if expired {
+				return "", &os.PathError{Op: "stat", Path: candidate, Err: errExpired}
+			}
+			return candidate, nil
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return "", &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+}
+
+// encode turns codec output into the bytes stored on disk, gzipping it
+// first if compress is set.
+func (d *Driver) encode(b []byte, compress bool) ([]byte, error) {
+	var err error
+	if compress {
+		if b, err = gzipBytes(b); err != nil {
+			return nil, err
+		}
+	}
+	if d.aead != nil {
+		if b, err = seal(d.aead, b); err != nil {
 			return nil, err
 		}
+	}
+	if d.checksum {
+		b = addChecksum(b)
+	}
+	return b, nil
+}
 
-		records = append(records, string(b))
+// readRecord reads a record file, decrypting and decompressing it as needed.
+func (d *Driver) readRecord(path string) ([]byte, error) {
+	b, err := d.fs.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
-	return records, nil
+	if b, err = checkChecksum(b); err != nil {
+		return nil, fmt.Errorf("unable to read %v: %w", path, err)
+	}
+	if d.aead != nil {
+		if b, err = unseal(d.aead, b); err != nil {
+			return nil, fmt.Errorf("unable to decrypt %v: %w", path, err)
+		}
+	}
+	if strings.HasSuffix(path, gzipExt) {
+		return gunzipBytes(b)
+	}
+	return b, nil
 }
 
-func (d *Driver) Delete(collection, resource string) error {
-	path := filepath.Join(collection, resource)
-	mutex := d.getOrCreateMutex(collection)
-	mutex.Lock()
-	defer mutex.Unlock()
+// wouldDelete logs the records a dry run leaves alone.
+func (d *Driver) wouldDelete(collection string, resources []string) {
+	for _, resource := range resources {
+		d.logger().Info("Dry run: would delete %v/%v\n", collection, resource)
+	}
+}
 
-	dir := filepath.Join(d.dir, path)
+// removeRecord deletes every stored form of a record along with its
+// sidecar files.
+func (d *Driver) removeRecord(collection, resource string) error {
+	if err := d.removeForms(filepath.Join(d.dir, collection), resource); err != nil {
+		return err
+	}
 
-	switch fi, err := stat(dir); {
-	case fi==nil,err!=nil:
-		return fmt.Errorf("unable to find file or directory name %v\n", path)
-	
-	case fi.Mode().IsDir():
-		return os.RemoveAll(dir)
+	d.changed(OpDelete, collection, resource)
+	return nil
+}
 
-	case fi.Mode().IsRegular():
-		return os.RemoveAll(dir+".json")
+// canonical returns the name a resource is stored under: lower-cased with
+// Options.CaseInsensitive, unchanged otherwise.
+func (d *Driver) canonical(resource string) string {
+	if !d.caseInsensitive {
+		return resource
 	}
+	return strings.ToLower(resource)
+}
 
-	return nil
+// recordForms lists the file names a resource may occupy: the record in
+// each of its encodings plus its sidecar files.
+func (d *Driver) recordForms(resource string) []string {
+	resource = d.canonical(resource)
+	name := resource + d.ext
+	return []string{name, name + gzipExt, resource + ttlExt, resource + versionExt}
 }
 
-func (d *Driver) getOrCreateMutex(collection string) *sync.Mutex {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
-	m, ok := d.mutexes[collection]
-	if !ok {
-		m = &sync.Mutex{}
-		d.mutexes[collection]=m
+// hasForms reports whether dir holds any file belonging to resource.
+func (d *Driver) hasForms(dir, resource string) bool {
+	for _, name := range d.recordForms(resource) {
+		if _, err := d.fs.Stat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
 	}
-	return m
+	return false
+}
+
+// removeForms deletes every file belonging to resource in dir.
+func (d *Driver) removeForms(dir, resource string) error {
+	for _, name := range d.recordForms(resource) {
+		if err := d.fs.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+
+// isRecord reports whether a directory entry is a stored record, as opposed
+// to a temp file, subdirectory or anything else.
+func (d *Driver) isRecord(file os.DirEntry) bool {
+	_, ok := d.resourceName(file.Name())
+	return ok && file.Type().IsRegular()
 }
 
-func stat(path string) (fi os.FileInfo, err error) {
-	if fi,err = os.Stat(path); os.IsNotExist(err) {
-		fi, err = os.Stat(path+ ".json")
+// resourceName strips the record extensions from a file name.
+func (d *Driver) resourceName(name string) (string, bool) {
+	name = strings.TrimSuffix(name, gzipExt)
+	if len(name) <= len(d.ext) || !strings.HasSuffix(name, d.ext) {
+		return "", false
 	}
-	return fi, err
+	return strings.TrimSuffix(name, d.ext), true
 }
 type User struct {
 	Name string
@@ -202,7 +2900,9 @@ func main() {
 	db, err := New(dir, nil)
 	if err != nil {
 		fmt.Println("Error", err)
+		return
 	}
+	defer db.Close()
 
 	employees := []User{
 		{"John","23","23344333", "Adobe", Address{"Bangalore","Karnataka","India","431013"}},
@@ -211,14 +2911,12 @@ func main() {
 		{"McAllen","28","33344233", "Meta", Address{"Gurugram","Uttar Pradesh","India","203021"}},
 	}
 
+	batch := make(map[string]interface{}, len(employees))
 	for _, employee := range employees {
-		db.Write("users",employee.Name, User{
-			Name: employee.Name,
-			Age: employee.Age,
-			Contact: employee.Contact,
-			Company: employee.Company,
-			Address: employee.Address,
-		})
+		batch[employee.Name] = employee
+	}
+	if err := db.WriteBatch("users", batch); err != nil {
+		fmt.Println("Error writing users: ", err)
 	}
 
 	records, err := db.ReadAll("users")
@@ -227,13 +2925,9 @@ func main() {
 	}
 	fmt.Println(records)
 
-	allUsers := []User{}
-	for _,f := range records {
-		employeeFound := User{}
-		if err := json.Unmarshal([]byte(f), &employeeFound); err != nil {
-			fmt.Println("Error finding user: ",err)
-		}
-		allUsers = append(allUsers, employeeFound)
+	allUsers, err := ReadAllInto[User](db, "users")
+	if err != nil {
+		fmt.Println("Error finding user: ",err)
 	}
 	fmt.Println(allUsers)
 
@@ -241,7 +2935,7 @@ func main() {
 	// 	fmt.Println("Error deleting from users table: ",err)
 	// }
 
-	// if err := db.Delete("users",""); err != nil {
+	// if err := db.DropCollection("users"); err != nil {
 	// 	fmt.Println("Error deleting all users: ", err)
 	// }
 }
\ No newline at end of file
@@ -0,0 +1,1117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestDriver opens a database in a fresh directory inside a parent
+// directory of its own, so tests can check nothing lands beside it.
+func newTestDriver(t *testing.T, opts *Options) *Driver {
+	t.Helper()
+
+	d, err := New(filepath.Join(t.TempDir(), "db"), opts)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// outside lists the files in the database's parent directory other than
+// the database itself: anything there was written by escaping it.
+func outside(t *testing.T, d *Driver) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(filepath.Dir(d.Dir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Name() != filepath.Base(d.Dir()) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+var traversals = []string{
+	"..",
+	"../escaped",
+	"../../escaped",
+	"a/../../escaped",
+	"..\\escaped",
+	"/tmp/escaped",
+	"escaped\x00",
+}
+
+func TestTraversalWrite(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	for _, name := range traversals {
+		if err := d.Write("users", name, "x"); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Write(users, %q) = %v, want ErrInvalidName", name, err)
+		}
+		if err := d.Write(name, "record", "x"); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Write(%q, record) = %v, want ErrInvalidName", name, err)
+		}
+	}
+
+	if names := outside(t, d); len(names) > 0 {
+		t.Fatalf("files written outside the database: %v", names)
+	}
+}
+
+func TestTraversalRead(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	secret := filepath.Join(filepath.Dir(d.Dir()), "secret.json")
+	if err := os.WriteFile(secret, []byte(`"secret"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"../secret", "users/../../secret", "../../" + filepath.Base(filepath.Dir(d.Dir())) + "/secret"} {
+		var v string
+		err := d.Read("users", name, &v)
+		if !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Read(users, %q) = %v, want ErrInvalidName", name, err)
+		}
+		if v != "" {
+			t.Errorf("Read(users, %q) read %q from outside the database", name, v)
+		}
+	}
+
+	if _, err := d.ReadAll(".."); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("ReadAll(..) = %v, want ErrInvalidName", err)
+	}
+}
+
+func TestTraversalDelete(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	victim := filepath.Join(filepath.Dir(d.Dir()), "victim.json")
+	if err := os.WriteFile(victim, []byte(`"victim"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"../victim", "a/../../victim"} {
+		if err := d.Delete("users", name); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Delete(users, %q) = %v, want ErrInvalidName", name, err)
+		}
+	}
+	if err := d.DropCollection(".."); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("DropCollection(..) = %v, want ErrInvalidName", err)
+	}
+
+	if _, err := os.Stat(victim); err != nil {
+		t.Fatalf("file outside the database was deleted: %v", err)
+	}
+	if _, err := os.Stat(d.Dir()); err != nil {
+		t.Fatalf("database directory was deleted: %v", err)
+	}
+}
+
+func TestTraversalMove(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	if err := d.Write("users", "john", "john"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range traversals {
+		if err := d.Move("users", "john", "users", name); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Move to users/%q = %v, want ErrInvalidName", name, err)
+		}
+		if err := d.Move("users", "john", name, "john"); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Move to %q/john = %v, want ErrInvalidName", name, err)
+		}
+		if err := d.Move("users", name, "users", "stolen"); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Move from users/%q = %v, want ErrInvalidName", name, err)
+		}
+	}
+
+	var v string
+	if err := d.Read("users", "john", &v); err != nil || v != "john" {
+		t.Fatalf("Read(users, john) = %q, %v after refused moves", v, err)
+	}
+	if names := outside(t, d); len(names) > 0 {
+		t.Fatalf("files written outside the database: %v", names)
+	}
+}
+
+func TestTraversalImportNDJSON(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	key := func(raw []byte) (string, error) { return "../escaped", nil }
+	n, err := d.ImportNDJSON("users", strings.NewReader(`{"Name":"x"}`+"\n"), key)
+	if !errors.Is(err, ErrInvalidName) || n != 0 {
+		t.Errorf("ImportNDJSON = %d, %v, want 0, ErrInvalidName", n, err)
+	}
+
+	n, err = d.ImportNDJSON("../escaped", strings.NewReader(`{"Name":"x"}`+"\n"), func([]byte) (string, error) { return "x", nil })
+	if !errors.Is(err, ErrInvalidName) || n != 0 {
+		t.Errorf("ImportNDJSON(../escaped) = %d, %v, want 0, ErrInvalidName", n, err)
+	}
+
+	if names := outside(t, d); len(names) > 0 {
+		t.Fatalf("files written outside the database: %v", names)
+	}
+}
+
+func TestCheckNames(t *testing.T) {
+	for _, name := range traversals {
+		if err := checkResource(name); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("checkResource(%q) = %v, want ErrInvalidName", name, err)
+		}
+		if err := checkCollection(name); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("checkCollection(%q) = %v, want ErrInvalidName", name, err)
+		}
+	}
+
+	for _, name := range []string{"john", "John Smith", "john.smith", "..john", "john.."} {
+		if err := checkResource(name); err != nil {
+			t.Errorf("checkResource(%q) = %v, want nil", name, err)
+		}
+	}
+	for _, name := range []string{"users", "users/active", "users/active/2024"} {
+		if err := checkCollection(name); err != nil {
+			t.Errorf("checkCollection(%q) = %v, want nil", name, err)
+		}
+	}
+}
+
+func TestConfine(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	for _, path := range []string{
+		filepath.Join(d.Dir(), "..", "escaped.json"),
+		filepath.Join(d.Dir(), "users", "..", "..", "escaped.json"),
+		filepath.Dir(d.Dir()),
+	} {
+		if err := d.confine(path); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("confine(%v) = %v, want ErrInvalidName", path, err)
+		}
+	}
+
+	for _, path := range []string{
+		d.Dir(),
+		filepath.Join(d.Dir(), "users", "john.json"),
+		filepath.Join(d.Dir(), "users", "active", "john.json"),
+	} {
+		if err := d.confine(path); err != nil {
+			t.Errorf("confine(%v) = %v, want nil", path, err)
+		}
+	}
+}
+
+func TestPlantedCollectionLink(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	elsewhere := filepath.Join(filepath.Dir(d.Dir()), "elsewhere")
+	if err := os.MkdirAll(elsewhere, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(elsewhere, "secret.json"), []byte(`"secret"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(elsewhere, filepath.Join(d.Dir(), "evil")); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	if err := d.Write("users", "john", "john"); err != nil {
+		t.Fatal(err)
+	}
+
+	refused := map[string]func() error{
+		"ReadAll": func() error { _, err := d.ReadAll("evil"); return err },
+		"Keys":    func() error { _, err := d.Keys("evil"); return err },
+		"Iterate": func() error {
+			return d.Iterate("evil", func(string, []byte) error { return nil })
+		},
+		"ReadPage":       func() error { _, err := d.ReadPage("evil", 0, 10); return err },
+		"ReadAfter":      func() error { _, _, err := d.ReadAfter("evil", "", 10); return err },
+		"Count":          func() error { _, err := d.Count("evil"); return err },
+		"PurgeExpired":   func() error { _, err := d.PurgeExpired("evil"); return err },
+		"Write":          func() error { return d.Write("evil", "planted", "x") },
+		"Move":           func() error { return d.Move("users", "john", "evil", "john") },
+		"Delete":         func() error { return d.Delete("evil", "secret") },
+		"DropCollection": func() error { return d.DropCollection("evil") },
+	}
+	for name, call := range refused {
+		if err := call(); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("%v through a planted link = %v, want ErrInvalidName", name, err)
+		}
+	}
+
+	if got, want := files(t, elsewhere), []string{"secret.json"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("files outside the database = %v, want %v", got, want)
+	}
+	var john string
+	if err := d.Read("users", "john", &john); err != nil {
+		t.Errorf("Read after refused Move = %v, want the record left in place", err)
+	}
+}
+
+// lockCount is how many collection and record locks d is holding on to.
+func lockCount(d *Driver) int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return len(d.mutexes)
+}
+
+func TestLocksReleasedAfterDrop(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	for i := 0; i < 100; i++ {
+		collection := fmt.Sprintf("tmp%d", i)
+		if err := d.Write(collection, "a", i); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.ReadAll(collection); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.DropCollection(collection); err != nil {
+			t.Fatal(err)
+		}
+		if n := lockCount(d); n != 0 {
+			t.Fatalf("after %d create/drop cycles %d locks are left", i+1, n)
+		}
+	}
+}
+
+func TestLocksReleasedAfterConcurrentUse(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				collection := fmt.Sprintf("c%d", i%4)
+				resource := fmt.Sprintf("r%d", (g+i)%5)
+				d.Write(collection, resource, i)
+				var v int
+				d.Read(collection, resource, &v)
+				d.ReadAll(collection)
+				d.TryWrite(collection, resource, i)
+				d.Delete(collection, resource)
+				if i%10 == 0 {
+					d.DropCollection(collection)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if n := lockCount(d); n != 0 {
+		t.Fatalf("%d locks are left after every call returned", n)
+	}
+}
+
+// files lists the files below dir by path relative to it, in name order.
+func files(t *testing.T, dir string) []string {
+	t.Helper()
+
+	var names []string
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		names = append(names, filepath.ToSlash(rel))
+		return err
+	})
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestDeleteRecord(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	for _, resource := range []string{"a", "b"} {
+		if err := d.Write("users", resource, resource); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := d.Delete("users", "a"); err != nil {
+		t.Fatalf("Delete(users, a) = %v", err)
+	}
+	var v string
+	if err := d.Read("users", "a", &v); !errors.Is(err, ErrResourceNotFound) {
+		t.Errorf("Read of deleted record = %v, want ErrResourceNotFound", err)
+	}
+	if err := d.Read("users", "b", &v); err != nil || v != "b" {
+		t.Errorf("Read(users, b) = %q, %v after deleting a", v, err)
+	}
+	if err := d.Delete("users", "a"); !errors.Is(err, ErrResourceNotFound) {
+		t.Errorf("second Delete(users, a) = %v, want ErrResourceNotFound", err)
+	}
+	if err := d.Delete("nobody", "a"); !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("Delete(nobody, a) = %v, want ErrCollectionNotFound", err)
+	}
+	if got := files(t, filepath.Join(d.Dir(), "users")); strings.Join(got, ",") != "b.json" {
+		t.Errorf("files left = %v, want [b.json]", got)
+	}
+}
+
+func TestDeleteCollection(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	if err := d.Write("users", "a", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write("users/active", "b", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write("companies", "c", "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	// an empty name is a mistake, not a request to drop the collection
+	if err := d.Delete("users", ""); !errors.Is(err, ErrMissingResource) {
+		t.Errorf("Delete(users, \"\") = %v, want ErrMissingResource", err)
+	}
+	if err := d.Collection("users").Delete(""); !errors.Is(err, ErrMissingResource) {
+		t.Errorf("Collection(users).Delete(\"\") = %v, want ErrMissingResource", err)
+	}
+	if records, err := d.ReadAll("users"); err != nil || len(records) != 1 {
+		t.Fatalf("ReadAll(users) = %v, %v after Delete(users, \"\")", records, err)
+	}
+
+	if err := d.DropCollection("users"); err != nil {
+		t.Fatalf("DropCollection(users) = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(d.Dir(), "users")); !os.IsNotExist(err) {
+		t.Errorf("users directory still there: %v", err)
+	}
+	if _, err := d.ReadAll("users/active"); !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("ReadAll of nested collection = %v, want ErrCollectionNotFound", err)
+	}
+	if err := d.DropCollection("users"); !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("second DropCollection(users) = %v, want ErrCollectionNotFound", err)
+	}
+	if records, err := d.ReadAll("companies"); err != nil || len(records) != 1 {
+		t.Errorf("ReadAll(companies) = %v, %v after deleting users", records, err)
+	}
+}
+
+func TestDeleteCompressed(t *testing.T) {
+	d := newTestDriver(t, &Options{Compress: true})
+
+	if err := d.Write("users", "a", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := files(t, filepath.Join(d.Dir(), "users")); strings.Join(got, ",") != "a.json.gz" {
+		t.Fatalf("files = %v, want [a.json.gz]", got)
+	}
+	if err := d.Delete("users", "a"); err != nil {
+		t.Fatalf("Delete of compressed record = %v", err)
+	}
+
+	// a record written before Compress was turned on is still found
+	plain, err := d.WithOptions(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.Write("users", "b", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete("users", "b"); err != nil {
+		t.Fatalf("Delete of uncompressed record = %v", err)
+	}
+
+	if got := files(t, filepath.Join(d.Dir(), "users")); len(got) > 0 {
+		t.Errorf("files left = %v, want none", got)
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	if err := d.WriteWithTTL("users", "a", "a", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if err := d.Delete("users", "a"); !errors.Is(err, ErrResourceNotFound) {
+		t.Errorf("Delete of expired record = %v, want ErrResourceNotFound", err)
+	}
+	if got := files(t, filepath.Join(d.Dir(), "users")); len(got) > 0 {
+		t.Errorf("files left = %v, want the expired record and its expiry removed", got)
+	}
+}
+
+func TestDeleteSoftDelete(t *testing.T) {
+	d := newTestDriver(t, &Options{SoftDelete: true})
+
+	if err := d.Write("users", "a", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete("users", "a"); err != nil {
+		t.Fatalf("Delete = %v", err)
+	}
+
+	var v string
+	if err := d.Read("users", "a", &v); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Read of soft-deleted record = %v, want ErrNotFound", err)
+	}
+	if got := files(t, filepath.Join(d.Dir(), trashDir)); strings.Join(got, ",") != "users/a.json" {
+		t.Errorf("trash = %v, want [users/a.json]", got)
+	}
+
+	if err := d.Restore("users", "a"); err != nil {
+		t.Fatalf("Restore = %v", err)
+	}
+	if err := d.Read("users", "a", &v); err != nil || v != "a" {
+		t.Errorf("Read of restored record = %q, %v", v, err)
+	}
+
+	if err := d.Write("users/active", "b", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DropCollection("users"); err != nil {
+		t.Fatalf("DropCollection(users) = %v", err)
+	}
+	if got := files(t, filepath.Join(d.Dir(), trashDir)); strings.Join(got, ",") != "users/a.json,users/active/b.json" {
+		t.Errorf("trash = %v, want the whole collection", got)
+	}
+}
+
+func TestCustomExt(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%v", compress), func(t *testing.T) {
+			d := newTestDriver(t, &Options{Ext: ".data", Compress: compress})
+
+			want := User{Name: "John", Age: "30", Address: Address{City: "Bangalore", Pincode: "560001"}}
+			if err := d.Write("users", "john", want); err != nil {
+				t.Fatal(err)
+			}
+
+			name := "john.data"
+			if compress {
+				name += gzipExt
+			}
+			if got := files(t, filepath.Join(d.Dir(), "users")); strings.Join(got, ",") != name {
+				t.Fatalf("files = %v, want [%v]", got, name)
+			}
+
+			var got User
+			if err := d.Read("users", "john", &got); err != nil || got != want {
+				t.Fatalf("Read = %+v, %v, want %+v", got, err, want)
+			}
+			if records, err := d.ReadAll("users"); err != nil || len(records) != 1 {
+				t.Fatalf("ReadAll = %v, %v", records, err)
+			}
+			if keys, err := d.Keys("users"); err != nil || strings.Join(keys, ",") != "john" {
+				t.Fatalf("Keys = %v, %v", keys, err)
+			}
+			if ok, err := d.Exists("users", "john"); err != nil || !ok {
+				t.Fatalf("Exists = %v, %v", ok, err)
+			}
+
+			if err := d.Delete("users", "john"); err != nil {
+				t.Fatalf("Delete = %v", err)
+			}
+			if got := files(t, filepath.Join(d.Dir(), "users")); len(got) > 0 {
+				t.Fatalf("files left after Delete = %v", got)
+			}
+		})
+	}
+}
+
+func TestScansShareCollection(t *testing.T) {
+	d := newTestDriver(t, nil)
+	for i := 0; i < 3; i++ {
+		if err := d.Write("users", fmt.Sprintf("u%d", i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	inside := make(chan struct{})
+	release := make(chan struct{})
+	iterated := make(chan error, 1)
+	go func() {
+		first := true
+		iterated <- d.Iterate("users", func(string, []byte) error {
+			if first {
+				first = false
+				close(inside)
+				<-release
+			}
+			return nil
+		})
+	}()
+	<-inside
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := d.ReadAll("users")
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ReadAll waited for an Iterate of the same collection")
+	}
+
+	// a write to a single record still waits for the scan
+	wrote := make(chan error, 1)
+	go func() { wrote <- d.Write("users", "u0", 10) }()
+	select {
+	case <-wrote:
+		t.Fatal("Write went ahead in the middle of an Iterate")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-iterated; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-wrote; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScanLockQueuesNewcomers(t *testing.T) {
+	var l scanLock
+	l.lock(scanning)
+
+	wrote := make(chan struct{})
+	go func() {
+		l.lock(writing)
+		close(wrote)
+		l.unlock(writing)
+	}()
+	for {
+		l.mu.Lock()
+		waiting := l.waiting[writing]
+		l.mu.Unlock()
+		if waiting > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// with a writer waiting, a second scan queues behind it
+	if l.tryLock(scanning) {
+		t.Fatal("scan joined while a writer was waiting")
+	}
+	l.unlock(scanning)
+	<-wrote
+
+	if !l.tryLock(scanning) {
+		t.Fatal("scan refused once the writer was done")
+	}
+}
+
+// BenchmarkWriteParallel writes from many goroutines at once, each to a
+// record of its own. Record locks let those writes run side by side; for
+// comparison, CollectionLock holds the whole collection for each write, as
+// a lock per collection would, and SameRecord has every goroutine write one
+// record.
+func TestPatch(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	record := map[string]interface{}{
+		"Name":    "John",
+		"Age":     30,
+		"Phone":   "123",
+		"Address": map[string]interface{}{"City": "Delhi", "Zip": "110001"},
+	}
+	if err := d.Write("users", "john", record); err != nil {
+		t.Fatal(err)
+	}
+
+	patch := map[string]interface{}{
+		"Age":     31,
+		"Phone":   nil,
+		"Address": map[string]interface{}{"Zip": nil, "Street": "Main"},
+	}
+	if err := d.Patch("users", "john", patch); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]interface{}{}
+	if err := d.Read("users", "john", &got); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(got), "map[Address:map[City:Delhi Street:Main] Age:31 Name:John]"; got != want {
+		t.Errorf("patched record = %v, want %v", got, want)
+	}
+
+	if err := d.Patch("users", "nobody", patch); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Patch of a missing record = %v, want ErrNotFound", err)
+	}
+}
+
+func BenchmarkWriteParallel(b *testing.B) {
+	for _, mode := range []string{"DistinctRecords", "CollectionLock", "SameRecord"} {
+		b.Run(mode, func(b *testing.B) {
+			d, err := New(b.TempDir(), nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer d.Close()
+
+			write := func(resource string) error { return d.Write("users", resource, User{Name: resource}) }
+			if mode == "CollectionLock" {
+				write = func(resource string) error {
+					mutex := d.getOrCreateMutex("users")
+					mutex.Lock()
+					defer mutex.Unlock()
+					_, err := d.write("users", resource, User{Name: resource})
+					return err
+				}
+			}
+
+			var next atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				resource := "shared"
+				if mode != "SameRecord" {
+					resource = fmt.Sprintf("r%d", next.Add(1))
+				}
+				for pb.Next() {
+					if err := write(resource); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestBlankNames(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	blanks := []string{
+		" ",
+		"   ",
+		"\t\n",
+		"\u00a0",       // no-break space
+		"\u2003\u2009", // em and thin spaces
+		"\u3000",       // ideographic space
+		"\u2028",       // line separator
+		" / ",
+		"/",
+		"\\",
+	}
+	for _, name := range blanks {
+		if err := d.Write("users", name, "x"); !errors.Is(err, ErrMissingResource) {
+			t.Errorf("Write(users, %q) = %v, want ErrMissingResource", name, err)
+		}
+		if err := d.Write(name, "x", "x"); !errors.Is(err, ErrMissingCollection) {
+			t.Errorf("Write(%q, x) = %v, want ErrMissingCollection", name, err)
+		}
+		var v string
+		if err := d.Read("users", name, &v); !errors.Is(err, ErrMissingResource) {
+			t.Errorf("Read(users, %q) = %v, want ErrMissingResource", name, err)
+		}
+	}
+
+	// callers checking for ErrInvalidName catch them too
+	if err := checkResource("\u00a0"); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("checkResource(nbsp) = %v, want ErrInvalidName too", err)
+	}
+
+	// names with spaces inside are fine
+	if err := d.Write("users", "John Smith", "x"); err != nil {
+		t.Errorf("Write(users, \"John Smith\") = %v", err)
+	}
+}
+
+func TestTrailingSeparators(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	for _, name := range []string{"a/", "a//", "a\\", "john /"} {
+		if err := d.Write("users", name, "x"); !errors.Is(err, ErrMissingResource) {
+			t.Errorf("Write(users, %q) = %v, want ErrMissingResource", name, err)
+		}
+		if err := d.Delete("users", name); !errors.Is(err, ErrMissingResource) {
+			t.Errorf("Delete(users, %q) = %v, want ErrMissingResource", name, err)
+		}
+	}
+
+	for _, name := range []string{"users/", "users//", "/users", "users//active", "users/ /active"} {
+		if err := d.Write(name, "x", "x"); !errors.Is(err, ErrMissingCollection) {
+			t.Errorf("Write(%q, x) = %v, want ErrMissingCollection", name, err)
+		}
+	}
+
+	if names := files(t, d.Dir()); len(names) > 0 {
+		t.Errorf("files written: %v", names)
+	}
+}
+
+// foldingStorage is osStorage on a filesystem that ignores case below
+// root, as on Windows or macOS: every name is stored lower-cased, so names
+// differing only in case are one file.
+type foldingStorage struct {
+	osStorage
+	root string
+}
+
+func (s foldingStorage) fold(path string) string {
+	rel, err := filepath.Rel(s.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+	return filepath.Join(s.root, strings.ToLower(rel))
+}
+
+func (s foldingStorage) Stat(path string) (os.FileInfo, error) {
+	return s.osStorage.Stat(s.fold(path))
+}
+
+func (s foldingStorage) ReadDir(path string) ([]os.DirEntry, error) {
+	return s.osStorage.ReadDir(s.fold(path))
+}
+
+func (s foldingStorage) ReadFile(path string) ([]byte, error) {
+	return s.osStorage.ReadFile(s.fold(path))
+}
+
+func (s foldingStorage) WriteFile(path string, data []byte, perm os.FileMode, sync bool) error {
+	return s.osStorage.WriteFile(s.fold(path), data, perm, sync)
+}
+
+func (s foldingStorage) Rename(oldpath, newpath string) error {
+	return s.osStorage.Rename(s.fold(oldpath), s.fold(newpath))
+}
+
+func (s foldingStorage) Remove(path string) error {
+	return s.osStorage.Remove(s.fold(path))
+}
+
+func (s foldingStorage) RemoveAll(path string) error {
+	return s.osStorage.RemoveAll(s.fold(path))
+}
+
+func (s foldingStorage) MkdirAll(path string, perm os.FileMode) error {
+	return s.osStorage.MkdirAll(s.fold(path), perm)
+}
+
+func (s foldingStorage) SyncDir(dir string) error {
+	return s.osStorage.SyncDir(s.fold(dir))
+}
+
+func (s foldingStorage) EvalSymlinks(path string) (string, error) {
+	return s.osStorage.EvalSymlinks(s.fold(path))
+}
+
+// filesystems opens a database with opts on a case-sensitive filesystem
+// and on a case-insensitive one.
+func filesystems(t *testing.T, opts Options) map[string]*Driver {
+	t.Helper()
+
+	folded := filepath.Join(t.TempDir(), "db")
+	insensitive := opts
+	insensitive.Storage = foldingStorage{root: folded}
+	d, err := New(folded, &insensitive)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+
+	return map[string]*Driver{
+		"case-sensitive":   newTestDriver(t, &opts),
+		"case-insensitive": d,
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	for name, d := range filesystems(t, Options{CaseInsensitive: true}) {
+		t.Run(name, func(t *testing.T) {
+			for _, resource := range []string{"John", "ALICE", "bob", "JOHN"} {
+				if err := d.Write("users", resource, resource); err != nil {
+					t.Fatalf("Write(users, %v) = %v", resource, err)
+				}
+			}
+
+			var john string
+			if err := d.Read("users", "john", &john); err != nil || john != "JOHN" {
+				t.Errorf("Read(users, john) = %q, %v, want the later write of JOHN", john, err)
+			}
+			if keys, err := d.Keys("users"); err != nil || strings.Join(keys, ",") != "alice,bob,john" {
+				t.Errorf("Keys = %v, %v, want [alice bob john]", keys, err)
+			}
+			if _, names, err := d.ReadAfter("users", "Alice", 10); err != nil || strings.Join(names, ",") != "bob,john" {
+				t.Errorf("ReadAfter(Alice) = %v, %v, want [bob john]", names, err)
+			}
+			if _, names, err := d.ReadAfter("users", "BOB", 10); err != nil || strings.Join(names, ",") != "john" {
+				t.Errorf("ReadAfter(BOB) = %v, %v, want [john]", names, err)
+			}
+
+			if err := d.WriteWithTTL("users", "Brief", "b", time.Millisecond); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.WriteWithTTL("users", "Lasting", "l", time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(5 * time.Millisecond)
+			var v string
+			if err := d.Read("users", "BRIEF", &v); !errors.Is(err, ErrResourceNotFound) {
+				t.Errorf("Read(users, BRIEF) after expiry = %v, want ErrResourceNotFound", err)
+			}
+			if err := d.Read("users", "lasting", &v); err != nil {
+				t.Errorf("Read(users, lasting) = %v", err)
+			}
+			if err := d.Write("users", "LASTING", "l"); err != nil {
+				t.Fatal(err)
+			}
+			if at, err := d.expiry("users", "Lasting"); err != nil || !at.IsZero() {
+				t.Errorf("expiry after plain Write = %v, %v, want it cleared", at, err)
+			}
+
+			if n, err := d.WriteIfVersion("users", "Mary", "m", 0); err != nil || n != 1 {
+				t.Fatalf("WriteIfVersion(Mary, 0) = %v, %v", n, err)
+			}
+			if _, err := d.WriteIfVersion("users", "mary", "m", 0); !errors.Is(err, ErrVersionConflict) {
+				t.Errorf("WriteIfVersion(mary, 0) = %v, want ErrVersionConflict", err)
+			}
+			if err := d.Write("users", "MaRy", "m"); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := d.Version("users", "MARY"); err != nil || n != 2 {
+				t.Errorf("Version(MARY) = %v, %v, want 2", n, err)
+			}
+
+			want := "alice.json,bob.json,john.json,lasting.json,mary.json,mary.ver"
+			if got := files(t, filepath.Join(d.Dir(), "users")); strings.Join(got, ",") != want {
+				t.Errorf("files = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestCaseSensitiveNames(t *testing.T) {
+	// without CaseInsensitive, names differing in case are separate records
+	// only where the filesystem tells them apart
+	want := map[string]string{"case-sensitive": "John,john", "case-insensitive": "john"}
+	for name, d := range filesystems(t, Options{}) {
+		t.Run(name, func(t *testing.T) {
+			for _, resource := range []string{"John", "john"} {
+				if err := d.Write("users", resource, resource); err != nil {
+					t.Fatalf("Write(users, %v) = %v", resource, err)
+				}
+			}
+
+			if keys, err := d.Keys("users"); err != nil || strings.Join(keys, ",") != want[name] {
+				t.Errorf("Keys = %v, %v, want [%v]", keys, err, want[name])
+			}
+			var v string
+			if err := d.Read("users", "JOHN", &v); !errors.Is(err, ErrResourceNotFound) && name == "case-sensitive" {
+				t.Errorf("Read(users, JOHN) = %v, want ErrResourceNotFound", err)
+			}
+		})
+	}
+}
+
+// createNested writes records to the new collection a/b/c from many
+// goroutines at once, dropping a alongside when drops is set, and reports
+// every error other than a drop finding nothing to drop.
+func createNested(t *testing.T, d *Driver, writers, records int, drops bool) {
+	t.Helper()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*writers*records)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < records; i++ {
+				if err := d.Write("a/b/c", fmt.Sprintf("w%d-%d", w, i), i); err != nil {
+					errs <- fmt.Errorf("Write(a/b/c): %w", err)
+				}
+			}
+		}(w)
+		if !drops || w%4 != 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < records; i++ {
+				if err := d.DropCollection("a"); err != nil && !errors.Is(err, ErrCollectionNotFound) {
+					errs <- fmt.Errorf("DropCollection(a): %w", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestCreateNestedCollectionConcurrently(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	const writers, records = 16, 20
+	createNested(t, d, writers, records, false)
+
+	if n, err := d.Count("a/b/c"); err != nil || n != writers*records {
+		t.Errorf("Count(a/b/c) = %v, %v, want %d", n, err, writers*records)
+	}
+	if got := len(files(t, d.Dir())); got != writers*records {
+		t.Errorf("%d files on disk, want %d", got, writers*records)
+	}
+	if n := lockCount(d); n != 0 {
+		t.Errorf("%d locks held after the writers finished", n)
+	}
+}
+
+func TestCreateNestedCollectionWhileDropping(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	createNested(t, d, 16, 20, true)
+
+	// whatever survived the drops must be whole records, with no staging
+	// files left behind
+	survivors, err := d.ReadAll("a/b/c")
+	if err != nil && !errors.Is(err, ErrCollectionNotFound) {
+		t.Fatalf("ReadAll(a/b/c) = %v", err)
+	}
+	names := files(t, d.Dir())
+	for _, name := range names {
+		if !strings.HasPrefix(name, "a/b/c/") || !strings.HasSuffix(name, ".json") {
+			t.Errorf("unexpected file %v", name)
+		}
+	}
+	if len(names) != len(survivors) {
+		t.Errorf("%d files on disk but ReadAll returned %d records", len(names), len(survivors))
+	}
+
+	if err := d.Write("a/b/c", "last", 0); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := d.Count("a/b/c"); err != nil || n != len(survivors)+1 {
+		t.Errorf("Count after a final write = %v, %v, want %d", n, err, len(survivors)+1)
+	}
+	if n := lockCount(d); n != 0 {
+		t.Errorf("%d locks held after the writers finished", n)
+	}
+}
+
+func TestDriverWithoutNew(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+	d := &Driver{dir: dir}
+
+	if err := d.Write("users", "john", User{Name: "John"}); err != nil {
+		t.Fatalf("Write = %v", err)
+	}
+	var john User
+	if err := d.Read("users", "john", &john); err != nil || john.Name != "John" {
+		t.Errorf("Read = %+v, %v, want John", john, err)
+	}
+	if keys, err := d.Keys("users"); err != nil || strings.Join(keys, ",") != "john" {
+		t.Errorf("Keys = %v, %v, want [john]", keys, err)
+	}
+	if got := files(t, dir); strings.Join(got, ",") != "users/john.json" {
+		t.Errorf("files = %v, want [users/john.json]", got)
+	}
+	if err := d.Close(); err != nil {
+		t.Errorf("Close = %v", err)
+	}
+
+	// every read path works as the first call on such a driver
+	reads := map[string]func(d *Driver) error{
+		"Read":           func(d *Driver) error { var u User; return d.Read("users", "john", &u) },
+		"ReadRaw":        func(d *Driver) error { _, err := d.ReadRaw("users", "john"); return err },
+		"ReadVersion":    func(d *Driver) error { var u User; _, err := d.ReadVersion("users", "john", &u); return err },
+		"ReadAll":        func(d *Driver) error { _, err := d.ReadAll("users"); return err },
+		"ReadAllLenient": func(d *Driver) error { _, _, err := d.ReadAllLenient("users"); return err },
+		"ReadAllMap":     func(d *Driver) error { _, err := d.ReadAllMap("users"); return err },
+		"ReadAllInto":    func(d *Driver) error { _, err := ReadAllInto[User](d, "users"); return err },
+		"Filter": func(d *Driver) error {
+			_, err := Filter(d, "users", func(User) bool { return true })
+			return err
+		},
+		"Select": func(d *Driver) error {
+			_, err := Select(d, "users", SelectOptions[User]{Limit: 1})
+			return err
+		},
+		"Query": func(d *Driver) error {
+			var out []User
+			return d.Query("users").Where("Name", "==", "John").Run(&out)
+		},
+		"FindBy": func(d *Driver) error { _, err := d.FindBy("users", "Name", "John"); return err },
+		"Iterate": func(d *Driver) error {
+			return d.Iterate("users", func(string, []byte) error { return nil })
+		},
+		"ReadPage":  func(d *Driver) error { _, err := d.ReadPage("users", 0, 10); return err },
+		"ReadAfter": func(d *Driver) error { _, _, err := d.ReadAfter("users", "", 10); return err },
+		"ExportNDJSON": func(d *Driver) error {
+			var b strings.Builder
+			return d.ExportNDJSON("users", &b)
+		},
+	}
+	for name, read := range reads {
+		if err := read(&Driver{dir: dir}); err != nil {
+			t.Errorf("%v on a Driver made without New = %v", name, err)
+		}
+	}
+
+	// without a directory there is nowhere to write, which is an error
+	// rather than a panic
+	var zero Driver
+	if err := zero.Write("users", "john", "x"); err == nil {
+		t.Error("Write on the zero Driver succeeded, want an error")
+	}
+	if err := zero.Close(); err != nil {
+		t.Errorf("Close of the zero Driver = %v", err)
+	}
+}
+
+func TestExportNDJSON(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	for _, name := range []string{"john", "ann"} {
+		if err := d.Write("users", name, map[string]string{"Name": name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var plain strings.Builder
+	if err := d.ExportNDJSON("users", &plain); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"Name":"ann"}` + "\n" + `{"Name":"john"}` + "\n"; plain.String() != want {
+		t.Errorf("ExportNDJSON wrote %q, want %q", plain.String(), want)
+	}
+
+	var named strings.Builder
+	if err := d.ExportNDJSONNamed("users", &named); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"resource":"ann","record":{"Name":"ann"}}` + "\n" + `{"resource":"john","record":{"Name":"john"}}` + "\n"
+	if named.String() != want {
+		t.Errorf("ExportNDJSONNamed wrote %q, want %q", named.String(), want)
+	}
+
+	// the plain lines import back under names taken from the records
+	key := func(raw []byte) (string, error) {
+		var v struct{ Name string }
+		err := json.Unmarshal(raw, &v)
+		return v.Name, err
+	}
+	if n, err := d.ImportNDJSON("copy", strings.NewReader(plain.String()), key); err != nil || n != 2 {
+		t.Errorf("ImportNDJSON of the export = %d, %v, want 2", n, err)
+	}
+}
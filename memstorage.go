@@ -0,0 +1,244 @@
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// memStorage keeps the whole database in process memory. Paths are mapped
+// onto a tree of nodes, so it behaves like a small private filesystem.
+type memStorage struct {
+	mu   sync.Mutex
+	root *memNode
+}
+
+type memNode struct {
+	name     string
+	mode     fs.FileMode
+	modTime  time.Time
+	data     []byte
+	children map[string]*memNode
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{root: &memNode{mode: fs.ModeDir | 0755, modTime: time.Now(), children: map[string]*memNode{}}}
+}
+
+func (n *memNode) isDir() bool { return n.mode.IsDir() }
+
+// memInfo adapts a node to fs.FileInfo.
+type memInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi memInfo) Name() string       { return fi.name }
+func (fi memInfo) Size() int64        { return fi.size }
+func (fi memInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi memInfo) ModTime() time.Time { return fi.modTime }
+func (fi memInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi memInfo) Sys() interface{}   { return nil }
+
+func (n *memNode) info() fs.FileInfo {
+	return memInfo{name: n.name, size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}
+}
+
+func splitPath(path string) []string {
+	var parts []string
+	for _, part := range strings.Split(filepath.ToSlash(filepath.Clean(path)), "/") {
+		if part != "" && part != "." {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// lookup finds the node at path. The caller must hold m.mu.
+func (m *memStorage) lookup(op, path string) (*memNode, error) {
+	n := m.root
+	for _, part := range splitPath(path) {
+		if !n.isDir() {
+			return nil, &fs.PathError{Op: op, Path: path, Err: syscall.ENOTDIR}
+		}
+		child, ok := n.children[part]
+		if !ok {
+			return nil, &fs.PathError{Op: op, Path: path, Err: fs.ErrNotExist}
+		}
+		n = child
+	}
+	return n, nil
+}
+
+// parent finds the directory that holds path, and path's base name.
+func (m *memStorage) parent(op, path string) (*memNode, string, error) {
+	parts := splitPath(path)
+	if len(parts) == 0 {
+		return nil, "", &fs.PathError{Op: op, Path: path, Err: fs.ErrInvalid}
+	}
+
+	dir, err := m.lookup(op, strings.Join(parts[:len(parts)-1], "/"))
+	if err != nil {
+		return nil, "", err
+	}
+	if !dir.isDir() {
+		return nil, "", &fs.PathError{Op: op, Path: path, Err: syscall.ENOTDIR}
+	}
+	return dir, parts[len(parts)-1], nil
+}
+
+func (m *memStorage) Stat(path string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, err := m.lookup("stat", path)
+	if err != nil {
+		return nil, err
+	}
+	return n.info(), nil
+}
+
+func (m *memStorage) ReadDir(path string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, err := m.lookup("readdir", path)
+	if err != nil {
+		return nil, err
+	}
+	if !n.isDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: path, Err: syscall.ENOTDIR}
+	}
+
+	entries := make([]fs.DirEntry, 0, len(n.children))
+	for _, child := range n.children {
+		entries = append(entries, fs.FileInfoToDirEntry(child.info()))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (m *memStorage) ReadFile(path string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, err := m.lookup("open", path)
+	if err != nil {
+		return nil, err
+	}
+	if n.isDir() {
+		return nil, &fs.PathError{Op: "read", Path: path, Err: syscall.EISDIR}
+	}
+	return append([]byte(nil), n.data...), nil
+}
+
+func (m *memStorage) WriteFile(path string, data []byte, perm fs.FileMode, sync bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, name, err := m.parent("open", path)
+	if err != nil {
+		return err
+	}
+	if existing, ok := dir.children[name]; ok && existing.isDir() {
+		return &fs.PathError{Op: "open", Path: path, Err: syscall.EISDIR}
+	}
+
+	dir.children[name] = &memNode{name: name, mode: perm.Perm(), modTime: time.Now(), data: append([]byte(nil), data...)}
+	return nil
+}
+
+func (m *memStorage) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldDir, oldName, err := m.parent("rename", oldpath)
+	if err != nil {
+		return err
+	}
+	n, ok := oldDir.children[oldName]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldpath, Err: fs.ErrNotExist}
+	}
+
+	newDir, newName, err := m.parent("rename", newpath)
+	if err != nil {
+		return err
+	}
+	if existing, ok := newDir.children[newName]; ok && existing != n {
+		if existing.isDir() != n.isDir() || (existing.isDir() && len(existing.children) > 0) {
+			return &fs.PathError{Op: "rename", Path: newpath, Err: fs.ErrExist}
+		}
+	}
+
+	delete(oldDir.children, oldName)
+	n.name = newName
+	newDir.children[newName] = n
+	return nil
+}
+
+func (m *memStorage) Remove(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, name, err := m.parent("remove", path)
+	if err != nil {
+		return err
+	}
+	n, ok := dir.children[name]
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: path, Err: fs.ErrNotExist}
+	}
+	if n.isDir() && len(n.children) > 0 {
+		return &fs.PathError{Op: "remove", Path: path, Err: syscall.ENOTEMPTY}
+	}
+
+	delete(dir.children, name)
+	return nil
+}
+
+func (m *memStorage) RemoveAll(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(splitPath(path)) == 0 {
+		m.root.children = map[string]*memNode{}
+		return nil
+	}
+
+	dir, name, err := m.parent("removeall", path)
+	if err != nil {
+		if pe, ok := err.(*fs.PathError); ok && pe.Err == fs.ErrNotExist {
+			return nil
+		}
+		return err
+	}
+	delete(dir.children, name)
+	return nil
+}
+
+func (m *memStorage) MkdirAll(path string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := m.root
+	for _, part := range splitPath(path) {
+		child, ok := n.children[part]
+		if !ok {
+			child = &memNode{name: part, mode: fs.ModeDir | perm.Perm(), modTime: time.Now(), children: map[string]*memNode{}}
+			n.children[part] = child
+		} else if !child.isDir() {
+			return &fs.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR}
+		}
+		n = child
+	}
+	return nil
+}
+
+func (m *memStorage) SyncDir(dir string) error { return nil }
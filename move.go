@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Rename gives a record a new name within its collection. It fails with
+// ErrExists if newResource is already taken; delete it first to replace
+// it.
+func (d *Driver) Rename(collection, oldResource, newResource string) error {
+	for _, resource := range []string{oldResource, newResource} {
+		if err := d.validate(collection, resource); err != nil {
+			return err
+		}
+	}
+
+	if err := d.checkDelete(collection, false); err != nil {
+		return err
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if err := d.checkMove(collection, oldResource, collection, newResource); err != nil {
+		return err
+	}
+
+	dir, err := d.collectionDir(collection)
+	if err != nil {
+		return err
+	}
+	if err := d.moveForms(dir, dir, oldResource, newResource); err != nil {
+		return err
+	}
+
+	d.changed(OpDelete, collection, oldResource)
+	d.changed(OpWrite, collection, newResource)
+	return nil
+}
+
+// Copy duplicates a record within its collection. It fails with ErrExists
+// if dstResource is already taken.
+func (d *Driver) Copy(collection, srcResource, dstResource string) error {
+	for _, resource := range []string{srcResource, dstResource} {
+		if err := d.validate(collection, resource); err != nil {
+			return err
+		}
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if err := d.checkMove(collection, srcResource, collection, dstResource); err != nil {
+		return err
+	}
+
+	dir, err := d.collectionDir(collection)
+	if err != nil {
+		return err
+	}
+	if err := d.copyForms(dir, dir, srcResource, dstResource); err != nil {
+		return err
+	}
+
+	d.changed(OpWrite, collection, dstResource)
+	return nil
+}
+
+// Move transfers a record to another collection, possibly under a new name,
+// creating the destination collection if needed. It fails with ErrExists if
+// the destination record is already taken. The record is renamed in one step
+// when both collections are on the same filesystem and copied then deleted
+// otherwise.
+func (d *Driver) Move(srcCollection, srcResource, dstCollection, dstResource string) error {
+	if err := d.validate(srcCollection, srcResource); err != nil {
+		return err
+	}
+
+	if err := d.validate(dstCollection, dstResource); err != nil {
+		return err
+	}
+
+	if err := d.checkDelete(srcCollection, false); err != nil {
+		return err
+	}
+
+	// always lock in name order so two opposing moves can't deadlock
+	first, second := srcCollection, dstCollection
+	if second < first {
+		first, second = second, first
+	}
+	mutex := d.getOrCreateMutex(first)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if second != first {
+		mutex := d.getOrCreateMutex(second)
+		mutex.Lock()
+		defer mutex.Unlock()
+	}
+
+	if err := d.checkMove(srcCollection, srcResource, dstCollection, dstResource); err != nil {
+		return err
+	}
+
+	srcDir, err := d.collectionDir(srcCollection)
+	if err != nil {
+		return err
+	}
+	dstDir, err := d.collectionDir(dstCollection)
+	if err != nil {
+		return err
+	}
+	if err := d.ensureCollection(dstCollection); err != nil {
+		return err
+	}
+
+	if err := d.moveForms(srcDir, dstDir, srcResource, dstResource); err != nil {
+		return err
+	}
+
+	d.changed(OpDelete, srcCollection, srcResource)
+	d.changed(OpWrite, dstCollection, dstResource)
+	return nil
+}
+
+// moveForms renames every file belonging to resource in srcDir to dstDir,
+// under the name dstResource, falling back to copy and delete when the two
+// directories are on different filesystems.
+func (d *Driver) moveForms(srcDir, dstDir, resource, dstResource string) error {
+	// clear out leftovers, such as a stale expiry, from an earlier record
+	if err := d.removeForms(dstDir, dstResource); err != nil {
+		return err
+	}
+
+	dstNames := d.recordForms(dstResource)
+	for i, name := range d.recordForms(resource) {
+		src, dst := filepath.Join(srcDir, name), filepath.Join(dstDir, dstNames[i])
+
+		err := d.fs.Rename(src, dst)
+		if errors.Is(err, syscall.EXDEV) {
+			err = d.moveAcross(src, dst)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveAcross moves a file between filesystems by copying it into place
+// and only then removing src.
+func (d *Driver) moveAcross(src, dst string) error {
+	fi, err := d.fs.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if err := d.copyFile(src, dst, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return d.fs.Remove(src)
+}
+
+// checkMove makes sure the source record exists and the destination does
+// not. The caller must hold both collections' locks.
+func (d *Driver) checkMove(srcCollection, srcResource, dstCollection, dstResource string) error {
+	if _, err := d.findRecord(srcCollection, srcResource); err != nil {
+		return d.recordNotFound(srcCollection, err)
+	}
+
+	if _, err := d.findRecord(dstCollection, dstResource); err == nil {
+		return fmt.Errorf("%w: %v/%v", ErrExists, dstCollection, dstResource)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// copyForms copies every file belonging to resource in srcDir to dstDir,
+// under the name dstResource. Each file is staged and renamed into place.
+func (d *Driver) copyForms(srcDir, dstDir, resource, dstResource string) error {
+	// clear out leftovers, such as a stale expiry, from an earlier record
+	if err := d.removeForms(dstDir, dstResource); err != nil {
+		return err
+	}
+
+	dstNames := d.recordForms(dstResource)
+	for i, name := range d.recordForms(resource) {
+		src := filepath.Join(srcDir, name)
+		fi, err := d.fs.Stat(src)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := d.copyFile(src, filepath.Join(dstDir, dstNames[i]), fi.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Query finds the records in a collection whose fields match a set of
+// conditions. Build one with Driver.Query and Where, then call Run.
+type Query struct {
+	d          *Driver
+	collection string
+	conds      []condition
+	err        error
+}
+
+type condition struct {
+	path  []string
+	op    string
+	value interface{}
+}
+
+// Query starts a query over a collection.
+func (d *Driver) Query(collection string) *Query {
+	return &Query{d: d, collection: collection}
+}
+
+// Where adds a condition that field must meet. field may reach into nested
+// objects with dots, as in "Address.City". op is one of ==, !=, <, <=, >
+// and >=. Numbers, including json.Number, compare by value and strings
+// lexically; a record missing the field, or holding a value of another
+// kind, never matches except under != against a value of another kind.
+func (q *Query) Where(field, op string, value interface{}) *Query {
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		if q.err == nil {
+			q.err = fmt.Errorf("query on %v: unknown operator %q", q.collection, op)
+		}
+		return q
+	}
+
+	q.conds = append(q.conds, condition{path: strings.Split(field, "."), op: op, value: value})
+	return q
+}
+
+// Run decodes every matching record, in name order, into out, which must
+// point to a slice.
+func (q *Query) Run(out interface{}) error {
+	if q.err != nil {
+		return q.err
+	}
+
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("query on %v: Run needs a pointer to a slice, not %T", q.collection, out)
+	}
+	slice := rv.Elem()
+	results := reflect.MakeSlice(slice.Type(), 0, 0)
+
+	codec := q.d.config(q.collection).codec
+	err := q.d.each(context.Background(), q.collection, func(resource string, raw []byte) error {
+		fields := map[string]interface{}{}
+		if err := q.d.decodeFields(q.collection, raw, &fields); err != nil {
+			return fmt.Errorf("unable to decode %s: %w", resource, err)
+		}
+		if !q.matches(fields) {
+			return nil
+		}
+
+		record := reflect.New(slice.Type().Elem())
+		if err := codec.Unmarshal(raw, record.Interface()); err != nil {
+			return fmt.Errorf("unable to decode %s: %w", resource, err)
+		}
+		results = reflect.Append(results, record.Elem())
+		return nil
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	slice.Set(results)
+	return nil
+}
+
+func (q *Query) matches(fields map[string]interface{}) bool {
+	for _, cond := range q.conds {
+		v, ok := lookupField(fields, cond.path)
+		if !ok || !cond.holds(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupField follows a dotted path through nested objects.
+func lookupField(fields map[string]interface{}, path []string) (interface{}, bool) {
+	var v interface{} = fields
+	for _, key := range path {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func (c condition) holds(v interface{}) bool {
+	var order int
+	if x, ok := number(v); ok {
+		y, ok := number(c.value)
+		if !ok {
+			return c.op == "!="
+		}
+		order = cmp.Compare(x, y)
+	} else if x, ok := v.(string); ok {
+		y, ok := c.value.(string)
+		if !ok {
+			return c.op == "!="
+		}
+		order = strings.Compare(x, y)
+	} else {
+		switch c.op {
+		case "==":
+			return jsonEqual(v, c.value)
+		case "!=":
+			return !jsonEqual(v, c.value)
+		}
+		return false
+	}
+
+	switch c.op {
+	case "==":
+		return order == 0
+	case "!=":
+		return order != 0
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	}
+	return order >= 0
+}
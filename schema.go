@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// ValidationError lists the ways a record failed its collection's schema
+// or registered type.
+type ValidationError struct {
+	Collection string
+	Resource   string
+	Problems   []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("record %v/%v does not match schema: %v",
+		e.Collection, e.Resource, strings.Join(e.Problems, "; "))
+}
+
+// SetSchema registers a JSON Schema that every record written to collection
+// must satisfy. Passing a nil schema removes it.
+//
+// The supported keywords are type, enum, const, properties, required,
+// additionalProperties, items, minItems, maxItems, minLength, maxLength,
+// pattern, minimum, maximum, exclusiveMinimum and exclusiveMaximum. Others are
+// ignored.
+func (d *Driver) SetSchema(collection string, schema []byte) error {
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+
+	if collection == "" {
+		return fmt.Errorf("%w - unable to set schema!", ErrMissingCollection)
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if schema == nil {
+		delete(d.schemas, collection)
+		return nil
+	}
+
+	var s map[string]interface{}
+	if err := json.Unmarshal(schema, &s); err != nil {
+		return fmt.Errorf("invalid schema for %v: %w", collection, err)
+	}
+	d.schemas[collection] = s
+	return nil
+}
+
+// typeCheck lists the ways v, as encoded by codec, fails to be a record of
+// a collection's registered type.
+type typeCheck func(codec Codec, v interface{}) ([]string, error)
+
+// RegisterType makes T the type of a collection's records: every value
+// written to it must survive being encoded, decoded into a T and encoded
+// again, with the collection's codec, or the write fails with a
+// *ValidationError naming the fields that don't. That catches a User
+// written to "companies", whose fields a Company lacks, or a string where
+// T has a number. Fields of T the value leaves out are fine, as they just
+// decode to their zero value. Values that are a T or *T always pass.
+//
+// Registering another type for the collection replaces T. Collections
+// without a registered type take any value, as before.
+func RegisterType[T any](d *Driver, collection string) error {
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+
+	if collection == "" {
+		return fmt.Errorf("%w - unable to register type!", ErrMissingCollection)
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	typ := reflect.TypeOf((*T)(nil)).Elem()
+	check := func(codec Codec, v interface{}) ([]string, error) {
+		if t := reflect.TypeOf(v); t == typ || t == reflect.PointerTo(typ) {
+			return nil, nil
+		}
+		return roundTrip(codec, v, new(T), typ)
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.types[collection] = check
+	return nil
+}
+
+// roundTrip encodes v, decodes it into dst, a pointer to a new value of
+// typ, then encodes that, and lists what was lost or changed on the way.
+func roundTrip(codec Codec, v, dst interface{}, typ reflect.Type) ([]string, error) {
+	b, err := codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := codec.Unmarshal(b, dst); err != nil {
+		return []string{fmt.Sprintf("(root): does not decode as %v: %v", typ, err)}, nil
+	}
+	back, err := codec.Marshal(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	var before, after interface{}
+	if err := codec.Unmarshal(b, &before); err != nil {
+		return nil, err
+	}
+	if err := codec.Unmarshal(back, &after); err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	diffDocs(before, after, "", typ, &problems)
+	return problems, nil
+}
+
+// diffDocs appends a problem for every field of before, found at path, that
+// after lacks or holds a different value for.
+func diffDocs(before, after interface{}, path string, typ reflect.Type, problems *[]string) {
+	where := path
+	if where == "" {
+		where = "(root)"
+	}
+
+	bm, ok := before.(map[string]interface{})
+	am, ok2 := after.(map[string]interface{})
+	if !ok || !ok2 {
+		if !reflect.DeepEqual(before, after) {
+			*problems = append(*problems, fmt.Sprintf("%s: %v becomes %v as %v", where, before, after, typ))
+		}
+		return
+	}
+
+	keys := make([]string, 0, len(bm))
+	for key := range bm {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		field := key
+		if path != "" {
+			field = path + "." + key
+		}
+		a, ok := am[key]
+		if !ok {
+			*problems = append(*problems, fmt.Sprintf("%s: not a field of %v", field, typ))
+			continue
+		}
+		diffDocs(bm[key], a, field, typ, problems)
+	}
+}
+
+// validateRecord checks v against the collection's registered type and
+// schema, if it has them.
+func (d *Driver) validateRecord(collection, resource string, v interface{}) error {
+	d.mutex.Lock()
+	schema, ok := d.schemas[collection]
+	check := d.types[collection]
+	d.mutex.Unlock()
+	if !ok && check == nil {
+		return nil
+	}
+
+	var problems []string
+	if check != nil {
+		found, err := check(d.config(collection).codec, v)
+		if err != nil {
+			return err
+		}
+		problems = append(problems, found...)
+	}
+
+	if ok {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		var doc interface{}
+		if err := dec.Decode(&doc); err != nil {
+			return err
+		}
+
+		checkSchema(schema, doc, "", &problems)
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Collection: collection, Resource: resource, Problems: problems}
+	}
+	return nil
+}
+
+// checkSchema appends a problem for every way doc, found at path, breaks
+// schema.
+func checkSchema(schema map[string]interface{}, doc interface{}, path string, problems *[]string) {
+	fail := func(format string, args ...interface{}) {
+		where := path
+		if where == "" {
+			where = "(root)"
+		}
+		*problems = append(*problems, where+": "+fmt.Sprintf(format, args...))
+	}
+
+	if t, ok := schema["type"]; ok && !matchesType(t, doc) {
+		fail("expected %v, got %v", t, jsonType(doc))
+		return
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if jsonEqual(e, doc) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must be one of %v", enum)
+		}
+	}
+
+	if c, ok := schema["const"]; ok && !jsonEqual(c, doc) {
+		fail("must be %v", c)
+	}
+
+	switch doc := doc.(type) {
+	case map[string]interface{}:
+		props, _ := schema["properties"].(map[string]interface{})
+
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, r := range required {
+				name, _ := r.(string)
+				if _, ok := doc[name]; !ok {
+					fail("missing required field %v", name)
+				}
+			}
+		}
+
+		keys := make([]string, 0, len(doc))
+		for k := range doc {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if sub, ok := props[k].(map[string]interface{}); ok {
+				checkSchema(sub, doc[k], joinPath(path, k), problems)
+				continue
+			}
+			switch extra := schema["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					fail("unexpected field %v", k)
+				}
+			case map[string]interface{}:
+				checkSchema(extra, doc[k], joinPath(path, k), problems)
+			}
+		}
+
+	case []interface{}:
+		if n, ok := number(schema["minItems"]); ok && float64(len(doc)) < n {
+			fail("must have at least %v items", n)
+		}
+		if n, ok := number(schema["maxItems"]); ok && float64(len(doc)) > n {
+			fail("must have at most %v items", n)
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range doc {
+				checkSchema(items, item, fmt.Sprintf("%v[%d]", path, i), problems)
+			}
+		}
+
+	case string:
+		length := float64(utf8.RuneCountInString(doc))
+		if n, ok := number(schema["minLength"]); ok && length < n {
+			fail("must be at least %v characters", n)
+		}
+		if n, ok := number(schema["maxLength"]); ok && length > n {
+			fail("must be at most %v characters", n)
+		}
+		if p, ok := schema["pattern"].(string); ok {
+			if re, err := regexp.Compile(p); err != nil {
+				fail("invalid pattern %q in schema", p)
+			} else if !re.MatchString(doc) {
+				fail("must match %q", p)
+			}
+		}
+
+	case json.Number:
+		f, _ := doc.Float64()
+		if n, ok := number(schema["minimum"]); ok && f < n {
+			fail("must be >= %v", n)
+		}
+		if n, ok := number(schema["maximum"]); ok && f > n {
+			fail("must be <= %v", n)
+		}
+		if n, ok := number(schema["exclusiveMinimum"]); ok && f <= n {
+			fail("must be > %v", n)
+		}
+		if n, ok := number(schema["exclusiveMaximum"]); ok && f >= n {
+			fail("must be < %v", n)
+		}
+	}
+}
+
+func matchesType(t interface{}, doc interface{}) bool {
+	switch t := t.(type) {
+	case string:
+		if t == "integer" {
+			n, ok := doc.(json.Number)
+			if !ok {
+				return false
+			}
+			f, err := n.Float64()
+			return err == nil && f == math.Trunc(f)
+		}
+		return jsonType(doc) == t
+	case []interface{}:
+		for _, each := range t {
+			if matchesType(each, doc) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func jsonType(doc interface{}) string {
+	switch doc.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number, float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", doc)
+}
+
+// jsonEqual compares two decoded JSON values, treating numbers by value.
+func jsonEqual(a, b interface{}) bool {
+	if x, ok := number(a); ok {
+		y, ok := number(b)
+		return ok && x == y
+	}
+	ab, _ := json.Marshal(a)
+	bb, _ := json.Marshal(b)
+	return bytes.Equal(ab, bb)
+}
+
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func joinPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+type company struct {
+	Name      string
+	Employees int
+}
+
+func TestRegisterType(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	if err := RegisterType[company](d, "companies"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Write("companies", "acme", company{Name: "Acme", Employees: 10}); err != nil {
+		t.Errorf("Write of a company = %v", err)
+	}
+	if err := d.Write("companies", "partial", map[string]interface{}{"Name": "Partial"}); err != nil {
+		t.Errorf("Write leaving fields out = %v, want it to pass", err)
+	}
+
+	var invalid *ValidationError
+	err := d.Write("companies", "john", User{Name: "John", Age: "30"})
+	if !errors.As(err, &invalid) || len(invalid.Problems) == 0 {
+		t.Errorf("Write of a User = %v, want a *ValidationError", err)
+	}
+	err = d.Write("companies", "typo", map[string]interface{}{"Name": "Typo", "Employees": "ten"})
+	if !errors.As(err, &invalid) {
+		t.Errorf("Write of a string for a number = %v, want a *ValidationError", err)
+	}
+	var v company
+	if err := d.Read("companies", "john", &v); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Read of a rejected record = %v, want it never written", err)
+	}
+
+	// other collections take anything
+	if err := d.Write("users", "john", User{Name: "John"}); err != nil {
+		t.Errorf("Write to a collection without a type = %v", err)
+	}
+}
+
+func TestRegisterTypeErrors(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	if err := RegisterType[company](d, ""); !errors.Is(err, ErrMissingCollection) {
+		t.Errorf("RegisterType(\"\") = %v, want ErrMissingCollection", err)
+	}
+	if err := RegisterType[company](d, "../escaped"); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("RegisterType(../escaped) = %v, want ErrInvalidName", err)
+	}
+
+	d.Close()
+	if err := RegisterType[company](d, "companies"); !errors.Is(err, ErrClosed) {
+		t.Errorf("RegisterType after Close = %v, want ErrClosed", err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Stats is a snapshot of the database's size.
+type Stats struct {
+	// Collections maps each collection to its number of live records.
+	Collections map[string]int
+	// Bytes is the total size of the files in every collection, including
+	// temp and sidecar files.
+	Bytes int64
+	// Mutexes is the number of collection locks the driver is holding on
+	// to.
+	Mutexes int
+}
+
+// Stats walks the database and reports record counts and disk usage. Each
+// collection is measured under its read lock, so the counts are consistent
+// per collection even while writes continue.
+func (d *Driver) Stats() (Stats, error) {
+	if err := d.checkOpen(); err != nil {
+		return Stats{}, err
+	}
+
+	collections, err := d.Collections()
+	if err != nil {
+		return Stats{}, err
+	}
+
+	stats := Stats{Collections: make(map[string]int, len(collections))}
+	for _, collection := range collections {
+		count, size, err := d.collectionSize(collection)
+		if err != nil {
+			return Stats{}, err
+		}
+		stats.Collections[collection] = count
+		stats.Bytes += size
+	}
+
+	d.mutex.Lock()
+	stats.Mutexes = len(d.mutexes)
+	d.mutex.Unlock()
+
+	return stats, nil
+}
+
+// collectionSize counts the live records in a collection, leaving out any
+// that have expired, and sums the size of every file in it.
+func (d *Driver) collectionSize(collection string) (int, int64, error) {
+	mutex := d.getOrCreateMutex(collection)
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	dir, err := d.collectionDir(collection)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	files, err := d.fs.ReadDir(dir)
+	if err != nil {
+		return 0, 0, notFound(err)
+	}
+
+	names, _, err := d.recordFiles(collection)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var size int64
+	for _, file := range files {
+		if !file.Type().IsRegular() {
+			continue
+		}
+
+		fi, err := file.Info()
+		if err != nil {
+			continue
+		}
+		size += fi.Size()
+	}
+	return len(names), size, nil
+}
+
+// Digest returns a SHA-256 hash, in hex, of a collection's resource names
+// and record contents. It stays the same for as long as the collection's
+// records do, and any write, delete or expiry changes it, so comparing two
+// digests tells whether a collection needs syncing. Records are hashed after
+// decompression and decryption, so the digest doesn't depend on how they are
+// stored.
+func (d *Driver) Digest(collection string) (string, error) {
+	h := sha256.New()
+	err := d.each(context.Background(), collection, func(resource string, raw []byte) error {
+		sum := sha256.Sum256(raw)
+		// a NUL can't appear in a name, so it keeps name/record pairs apart
+		h.Write([]byte(resource))
+		h.Write([]byte{0})
+		h.Write(sum[:])
+		return nil
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Storage is the set of filesystem operations the driver is built on. Paths
+// are slash- or OS-separated paths as built by filepath.Join, rooted at the
+// database directory. A path that does not exist must produce an error
+// matching fs.ErrNotExist, as the os package's do.
+type Storage interface {
+	Stat(path string) (fs.FileInfo, error)
+	ReadDir(path string) ([]fs.DirEntry, error)
+	ReadFile(path string) ([]byte, error)
+	// WriteFile creates or truncates path; with sync set the data must be
+	// on stable storage before it returns.
+	WriteFile(path string, data []byte, perm fs.FileMode, sync bool) error
+	Rename(oldpath, newpath string) error
+	Remove(path string) error
+	RemoveAll(path string) error
+	MkdirAll(path string, perm fs.FileMode) error
+	// SyncDir makes earlier renames and removals in dir durable.
+	SyncDir(dir string) error
+}
+
+// resolver is implemented by storage that can hold symbolic links.
+// EvalSymlinks returns path with every link in it followed, as
+// filepath.EvalSymlinks does.
+type resolver interface {
+	EvalSymlinks(path string) (string, error)
+}
+
+// streamer is implemented by storage that can write and read a file a
+// piece at a time, so WriteReader and ReadReader needn't hold a whole
+// record in memory.
+type streamer interface {
+	// Create creates or truncates path for writing.
+	Create(path string, perm fs.FileMode) (syncWriter, error)
+	Open(path string) (io.ReadCloser, error)
+}
+
+// syncWriter is a file being written through a streamer.
+type syncWriter interface {
+	io.WriteCloser
+	// Sync puts the data written so far on stable storage.
+	Sync() error
+}
+
+// osStorage is the default storage, backed by the local filesystem.
+type osStorage struct{}
+
+func (osStorage) Stat(path string) (fs.FileInfo, error)      { return os.Stat(path) }
+func (osStorage) ReadDir(path string) ([]fs.DirEntry, error) { return os.ReadDir(path) }
+func (osStorage) ReadFile(path string) ([]byte, error)       { return os.ReadFile(path) }
+func (osStorage) Rename(oldpath, newpath string) error       { return os.Rename(oldpath, newpath) }
+func (osStorage) Remove(path string) error                   { return os.Remove(path) }
+func (osStorage) RemoveAll(path string) error                { return os.RemoveAll(path) }
+
+func (osStorage) EvalSymlinks(path string) (string, error) { return filepath.EvalSymlinks(path) }
+
+func (osStorage) Open(path string) (io.ReadCloser, error) { return os.Open(path) }
+
+func (osStorage) Create(path string, perm fs.FileMode) (syncWriter, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+}
+
+func (osStorage) MkdirAll(path string, perm fs.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osStorage) WriteFile(path string, data []byte, perm fs.FileMode, sync bool) error {
+	if !sync {
+		return os.WriteFile(path, data, perm)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func (osStorage) SyncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// walk is filepath.WalkDir over the driver's storage: fn is called for
+// root and everything below it, parents before children and siblings in
+// name order.
+func (d *Driver) walk(root string, fn fs.WalkDirFunc) error {
+	fi, err := d.fs.Stat(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+
+	err = d.walkDir(root, fs.FileInfoToDirEntry(fi), fn)
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func (d *Driver) walkDir(path string, entry fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(path, entry, nil); err != nil || !entry.IsDir() {
+		if err == filepath.SkipDir && entry.IsDir() {
+			err = nil
+		}
+		return err
+	}
+
+	entries, err := d.fs.ReadDir(path)
+	if err != nil {
+		if err = fn(path, entry, err); err != nil {
+			if err == filepath.SkipDir {
+				err = nil
+			}
+			return err
+		}
+	}
+
+	for _, child := range entries {
+		if err := d.walkDir(filepath.Join(path, child.Name()), child, fn); err != nil {
+			if err == filepath.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies a file within the driver's storage, staging it next to
+// dst and renaming it into place.
+func (d *Driver) copyFile(src, dst string, perm fs.FileMode) error {
+	b, err := d.fs.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	if err := d.fs.WriteFile(dst+".tmp", b, perm, d.sync); err != nil {
+		d.fs.Remove(dst + ".tmp")
+		return err
+	}
+	return d.fs.Rename(dst+".tmp", dst)
+}
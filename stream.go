@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// WriteReader stores everything read from r as a record, as is: it bypasses
+// the codec, so the caller is responsible for the data being in a format
+// the rest of the database can read. The data is copied straight into the
+// temp file and renamed into place like any other write, without being held
+// in memory, unless Options.EncryptionKey or Options.Checksum need the whole
+// record at once, or the Storage can't stream. Schemas are not checked.
+func (d *Driver) WriteReader(collection, resource string, r io.Reader) error {
+	if err := d.validate(collection, resource); err != nil {
+		return err
+	}
+
+	unlock := d.lockRecord(collection, resource, true)
+	defer unlock()
+
+	if err := d.checkOverwrite(collection, resource); err != nil {
+		return err
+	}
+
+	start := time.Now()
+
+	tmpPath, n, err := d.stageReader(collection, resource, r)
+	if err != nil {
+		return err
+	}
+
+	if err := d.commit(collection, resource, tmpPath); err != nil {
+		return err
+	}
+
+	if d.sync {
+		if err := d.fs.SyncDir(filepath.Join(d.dir, collection)); err != nil {
+			return err
+		}
+	}
+
+	d.logger().Trace("Wrote %v/%v: %d bytes in %v\n", collection, resource, n, time.Since(start))
+	return nil
+}
+
+// stageReader is stage for WriteReader.
+func (d *Driver) stageReader(collection, resource string, r io.Reader) (string, int64, error) {
+	tmpPath, err := d.tempPath(collection, resource)
+	if err != nil {
+		return "", 0, err
+	}
+
+	cfg := d.config(collection)
+	s, ok := d.fs.(streamer)
+	if !ok || d.aead != nil || d.checksum {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return "", 0, err
+		}
+		if b, err = d.encode(b, cfg.compress); err != nil {
+			return "", 0, err
+		}
+		if err := d.fs.WriteFile(tmpPath, b, cfg.filePerm, d.sync); err != nil {
+			d.fs.Remove(tmpPath)
+			return "", 0, err
+		}
+		return tmpPath, int64(len(b)), nil
+	}
+
+	f, err := s.Create(tmpPath, cfg.filePerm)
+	if err != nil {
+		return "", 0, err
+	}
+
+	n, err := copyEncoded(f, r, cfg.compress)
+	if err == nil && d.sync {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		d.fs.Remove(tmpPath)
+		return "", 0, err
+	}
+	return tmpPath, n, nil
+}
+
+// copyEncoded copies r to w, gzipping it if compress is set, and returns
+// the number of bytes written to w.
+func copyEncoded(w io.Writer, r io.Reader, compress bool) (int64, error) {
+	cw := &countingWriter{w: w}
+	if !compress {
+		_, err := io.Copy(cw, r)
+		return cw.n, err
+	}
+
+	zw := gzip.NewWriter(cw)
+	if _, err := io.Copy(zw, r); err != nil {
+		return 0, err
+	}
+	err := zw.Close()
+	return cw.n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// ReadReader returns a reader over a record's raw data, as ReadRaw does,
+// without reading it all into memory first where it can. The caller must
+// close it. The record is opened under its read lock; a later write
+// replaces the file instead of changing it, so the reader goes on seeing
+// the record as it was when opened.
+func (d *Driver) ReadReader(collection, resource string) (io.ReadCloser, error) {
+	s, ok := d.fs.(streamer)
+	if !ok || d.aead != nil {
+		b, err := d.readBytes(context.Background(), collection, resource)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+
+	if err := d.validate(collection, resource); err != nil {
+		return nil, err
+	}
+
+	// expired records are removed once the read lock is released
+	var expired []string
+	defer func() { d.dropExpired(collection, expired) }()
+
+	unlock := d.lockRecord(collection, resource, false)
+	defer unlock()
+
+	if d.cache != nil {
+		if b, ok := d.cache.get(cacheKey(collection, d.canonical(resource))); ok {
+			return io.NopCloser(bytes.NewReader(b)), nil
+		}
+	}
+
+	record, err := d.findRecord(collection, resource)
+	if err != nil {
+		if errors.Is(err, errExpired) {
+			expired = append(expired, resource)
+		}
+		return nil, d.recordNotFound(collection, err)
+	}
+
+	f, err := s.Open(record)
+	if err != nil {
+		return nil, d.recordNotFound(collection, err)
+	}
+
+	br := bufio.NewReader(f)
+	if head, _ := br.Peek(len(sumMagic)); bytes.Equal(head, sumMagic) {
+		// a checksum can only be checked once the whole record is in
+		f.Close()
+		b, err := d.readRecord(record)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+
+	if !strings.HasSuffix(record, gzipExt) {
+		return readCloser{br, f}, nil
+	}
+
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unable to read %v: %w", record, err)
+	}
+	return readCloser{zr, f}, nil
+}
+
+// readCloser reads from one reader and closes the file underneath it.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+)
+
+// trashDir is the directory under the database root that soft-deleted
+// records are moved into, laid out by collection.
+const trashDir = ".trash"
+
+// Restore brings back a soft-deleted record. It fails if the record has
+// since been written again.
+func (d *Driver) Restore(collection, resource string) error {
+	if err := d.validate(collection, resource); err != nil {
+		return err
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	trash := filepath.Join(d.dir, trashDir, collection)
+	if !d.hasForms(trash, resource) {
+		return fmt.Errorf("%w: %v/%v is not in the trash", ErrNotFound, collection, resource)
+	}
+
+	if _, err := d.findRecord(collection, resource); err == nil {
+		return fmt.Errorf("%w: %v/%v", ErrExists, collection, resource)
+	}
+
+	dir, err := d.collectionDir(collection)
+	if err != nil {
+		return err
+	}
+	if err := d.ensureCollection(collection); err != nil {
+		return err
+	}
+	if err := d.moveForms(trash, dir, resource, resource); err != nil {
+		return err
+	}
+
+	d.changed(OpWrite, collection, resource)
+	return nil
+}
+
+// PurgeTrash permanently removes a collection's soft-deleted records.
+func (d *Driver) PurgeTrash(collection string) error {
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+
+	if collection == "" {
+		return fmt.Errorf("%w - unable to purge trash!", ErrMissingCollection)
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return d.fs.RemoveAll(filepath.Join(d.dir, trashDir, collection))
+}
+
+// trashRecord moves a record into the trash, replacing any earlier deleted
+// copy of it.
+func (d *Driver) trashRecord(collection, resource string) error {
+	trash := filepath.Join(d.dir, trashDir, collection)
+	if err := d.fs.MkdirAll(trash, d.config(collection).dirPerm); err != nil {
+		return err
+	}
+	if err := d.removeForms(trash, resource); err != nil {
+		return err
+	}
+	if err := d.moveForms(filepath.Join(d.dir, collection), trash, resource, resource); err != nil {
+		return err
+	}
+
+	d.changed(OpDelete, collection, resource)
+	return nil
+}
+
+// trashTree moves every file below a collection directory into the trash,
+// keeping their relative paths, and then removes the directory.
+func (d *Driver) trashTree(collection string) error {
+	dir := filepath.Join(d.dir, collection)
+	trash := filepath.Join(d.dir, trashDir, collection)
+
+	err := d.walk(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		dst := filepath.Join(trash, rel)
+		perm := d.configAt(filepath.Join(collection, filepath.Dir(rel))).dirPerm
+		if err := d.fs.MkdirAll(filepath.Dir(dst), perm); err != nil {
+			return err
+		}
+		return d.fs.Rename(path, dst)
+	})
+	if err != nil {
+		return err
+	}
+	return d.fs.RemoveAll(dir)
+}
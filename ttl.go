@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ttlExt names the sidecar file holding a record's expiry time.
+const ttlExt = ".ttl"
+
+// expiredError marks a record whose TTL has passed. It matches
+// fs.ErrNotExist, so expired records read exactly like missing ones.
+type expiredError struct{}
+
+func (expiredError) Error() string        { return "record expired" }
+func (expiredError) Is(target error) bool { return target == fs.ErrNotExist }
+
+var errExpired error = expiredError{}
+
+// WriteWithTTL writes a record that expires after ttl. Once expired, the
+// record is treated as not found and removed the next time it is read. A ttl
+// of zero or less means the record never expires, exactly as with Write. A
+// later plain Write to the same resource clears the expiry.
+func (d *Driver) WriteWithTTL(collection, resource string, v interface{}, ttl time.Duration) error {
+	if err := d.validate(collection, resource); err != nil {
+		return err
+	}
+
+	if ttl > 0 {
+		if err := d.checkDelete(collection, false); err != nil {
+			return err
+		}
+	}
+
+	unlock := d.lockRecord(collection, resource, true)
+	defer unlock()
+
+	if _, err := d.write(collection, resource, v); err != nil {
+		return err
+	}
+
+	if ttl <= 0 {
+		return nil
+	}
+
+	path := d.ttlPath(collection, resource)
+	b := []byte(time.Now().Add(ttl).UTC().Format(time.RFC3339Nano) + "\n")
+
+	if err := d.fs.WriteFile(path+".tmp", b, d.config(collection).filePerm, d.sync); err != nil {
+		return err
+	}
+	return d.fs.Rename(path+".tmp", path)
+}
+
+// PurgeExpired removes every expired record in a collection and returns how
+// many it removed.
+func (d *Driver) PurgeExpired(collection string) (int, error) {
+	if err := d.checkOpen(); err != nil {
+		return 0, err
+	}
+
+	if collection == "" {
+		return 0, fmt.Errorf("%w - unable to purge", ErrMissingCollection)
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return 0, err
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	dir, err := d.collectionDir(collection)
+	if err != nil {
+		return 0, err
+	}
+
+	files, err := d.fs.ReadDir(dir)
+	if err != nil {
+		return 0, notFound(err)
+	}
+
+	purged := 0
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ttlExt) {
+			continue
+		}
+		resource := strings.TrimSuffix(file.Name(), ttlExt)
+
+		expired, err := d.isExpired(collection, resource)
+		if err != nil {
+			return purged, err
+		}
+		if !expired {
+			continue
+		}
+
+		if err := d.removeRecord(collection, resource); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+func (d *Driver) ttlPath(collection, resource string) string {
+	return filepath.Join(d.dir, collection, d.canonical(resource)+ttlExt)
+}
+
+// isExpired reports whether a record has a TTL that has passed.
+func (d *Driver) isExpired(collection, resource string) (bool, error) {
+	expires, err := d.expiry(collection, resource)
+	if err != nil || expires.IsZero() {
+		return false, err
+	}
+	return !time.Now().Before(expires), nil
+}
+
+// expiry returns when a record expires, or the zero time if it has no TTL.
+func (d *Driver) expiry(collection, resource string) (time.Time, error) {
+	b, err := d.fs.ReadFile(d.ttlPath(collection, resource))
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	expires, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(b)))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("corrupt expiry for %v/%v: %w", collection, resource, err)
+	}
+	return expires, nil
+}
+
+// dropExpired removes the given records if they are still expired. Reads
+// call it once they have released their read lock.
+func (d *Driver) dropExpired(collection string, resources []string) {
+	if len(resources) == 0 {
+		return
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, resource := range resources {
+		if expired, err := d.isExpired(collection, resource); err == nil && expired {
+			if err := d.removeRecord(collection, resource); err != nil {
+				d.logger().Warn("Unable to remove expired record %v/%v: %v\n", collection, resource, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteWithTTL(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	if err := d.WriteWithTTL("users", "brief", "b", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WriteWithTTL("users", "lasting", "l", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WriteWithTTL("users", "forever", "f", 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	var v string
+	if err := d.Read("users", "brief", &v); !errors.Is(err, ErrNotFound) || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Read of an expired record = %v, want ErrNotFound", err)
+	}
+	if err := d.Read("users", "lasting", &v); err != nil || v != "l" {
+		t.Errorf("Read(lasting) = %q, %v before it expires", v, err)
+	}
+	records, err := d.ReadAll("users")
+	if err != nil || len(records) != 2 {
+		t.Errorf("ReadAll = %v, %v, want lasting and forever only", records, err)
+	}
+	if got := strings.Join(files(t, filepath.Join(d.dir, "users")), ","); got != "forever.json,lasting.json,lasting.ttl" {
+		t.Errorf("files = %v, want the expired record removed once read", got)
+	}
+
+	// a plain write clears the expiry
+	if err := d.Write("users", "lasting", "l"); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(files(t, filepath.Join(d.dir, "users")), ","); got != "forever.json,lasting.json" {
+		t.Errorf("files after a plain Write = %v, want the expiry gone", got)
+	}
+}
+
+func TestPurgeExpired(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	for _, name := range []string{"a", "b", "c"} {
+		if err := d.WriteWithTTL("sessions", name, name, time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.WriteWithTTL("sessions", "kept", "k", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if n, err := d.PurgeExpired("sessions"); err != nil || n != 3 {
+		t.Errorf("PurgeExpired = %d, %v, want 3", n, err)
+	}
+	if got := strings.Join(files(t, filepath.Join(d.dir, "sessions")), ","); got != "kept.json,kept.ttl" {
+		t.Errorf("files after PurgeExpired = %v, want only kept", got)
+	}
+	if n, err := d.PurgeExpired("sessions"); err != nil || n != 0 {
+		t.Errorf("second PurgeExpired = %d, %v, want 0", n, err)
+	}
+	if _, err := d.PurgeExpired("nobody"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("PurgeExpired(nobody) = %v, want ErrNotFound", err)
+	}
+}
+
+func TestStatsSkipsExpired(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	if err := d.WriteWithTTL("sessions", "brief", "b", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WriteWithTTL("sessions", "kept", "k", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	stats, err := d.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := stats.Collections["sessions"]; n != 1 {
+		t.Errorf("Stats counts %v records in sessions, want 1 with the expired one left out", n)
+	}
+	if n, err := d.Count("sessions"); err != nil || n != stats.Collections["sessions"] {
+		t.Errorf("Count = %v, %v, want it to agree with Stats", n, err)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// journalPrefix starts the names of transaction journals, which sit in the
+// database root while a transaction is being applied.
+const journalPrefix = ".journal-"
+
+// Tx collects the writes and deletes of a Transaction. None of them is
+// visible to anyone until the transaction commits.
+type Tx struct {
+	d    *Driver
+	ops  []txOp
+	keys map[string]int
+	done bool
+}
+
+type txOp struct {
+	collection string
+	resource   string
+	v          interface{}
+	delete     bool
+}
+
+// journal lists what a transaction is about to do, so a crash part way
+// through can be rolled forward when the database is next opened.
+type journal struct {
+	Writes  []journalEntry `json:"writes,omitempty"`
+	Deletes []journalEntry `json:"deletes,omitempty"`
+}
+
+type journalEntry struct {
+	Collection string `json:"collection"`
+	Resource   string `json:"resource"`
+	Temp       string `json:"temp,omitempty"`
+	Path       string `json:"path,omitempty"`
+}
+
+// Write queues v to be saved as a record when the transaction commits. A
+// later Write or Delete of the same record in the transaction replaces it.
+func (tx *Tx) Write(collection, resource string, v interface{}) error {
+	if err := tx.check(collection, resource); err != nil {
+		return err
+	}
+	tx.queue(txOp{collection: collection, resource: resource, v: v})
+	return nil
+}
+
+// Delete queues a record to be deleted when the transaction commits. The
+// record must exist by then, or the whole transaction fails.
+func (tx *Tx) Delete(collection, resource string) error {
+	if err := tx.check(collection, resource); err != nil {
+		return err
+	}
+	tx.queue(txOp{collection: collection, resource: resource, delete: true})
+	return nil
+}
+
+func (tx *Tx) check(collection, resource string) error {
+	if tx.done {
+		return errors.New("transaction already finished")
+	}
+
+	return tx.d.validate(collection, resource)
+}
+
+func (tx *Tx) queue(op txOp) {
+	key := recordKey(op.collection, tx.d.canonical(op.resource))
+	if i, ok := tx.keys[key]; ok {
+		tx.ops[i] = op
+		return
+	}
+	tx.keys[key] = len(tx.ops)
+	tx.ops = append(tx.ops, op)
+}
+
+// Transaction runs fn and then applies the writes and deletes it queued on
+// tx all together: either every one of them takes effect or none does.
+// If fn returns an error nothing is applied and the error is returned.
+//
+// Every collection involved is locked while the changes are applied, so
+// readers see the records either all before or all after the transaction.
+// The new records are first staged and fsynced, then a journal listing the
+// changes is written, and only then are the records renamed into place. A
+// crash before the journal is complete leaves the database as it was; a
+// crash after, part way through the renames, is rolled forward when the
+// database is next opened. With FlushInterval or FlushSize set the journal
+// is buffered too, so the transaction is atomic to readers but not across
+// a crash.
+func (d *Driver) Transaction(fn func(tx *Tx) error) error {
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+
+	tx := &Tx{d: d, keys: make(map[string]int)}
+	err := fn(tx)
+	tx.done = true
+	if err != nil {
+		return err
+	}
+	if len(tx.ops) == 0 {
+		return nil
+	}
+	return d.commitTx(tx.ops)
+}
+
+func (d *Driver) commitTx(ops []txOp) error {
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	var collections []string
+	for _, op := range ops {
+		if op.delete {
+			if err := d.checkDelete(op.collection, false); err != nil {
+				return err
+			}
+		}
+		if !seen[op.collection] {
+			seen[op.collection] = true
+			collections = append(collections, op.collection)
+		}
+	}
+
+	// always lock in name order so transactions can't deadlock each other
+	sort.Strings(collections)
+	for _, collection := range collections {
+		mutex := d.getOrCreateMutex(collection)
+		mutex.Lock()
+		defer mutex.Unlock()
+	}
+
+	var j journal
+	var writes, deletes []txOp
+	for _, op := range ops {
+		if op.delete {
+			if _, err := d.findRecord(op.collection, op.resource); err != nil {
+				return d.recordNotFound(op.collection, err)
+			}
+			deletes = append(deletes, op)
+			continue
+		}
+		if err := d.checkOverwrite(op.collection, op.resource); err != nil {
+			return err
+		}
+		writes = append(writes, op)
+	}
+
+	discard := func() {
+		for _, w := range j.Writes {
+			d.fs.Remove(w.Temp)
+		}
+	}
+
+	dirs := make(map[string]bool)
+	for _, op := range writes {
+		tmpPath, _, err := d.stage(op.collection, op.resource, op.v, true)
+		if err != nil {
+			discard()
+			return fmt.Errorf("unable to write %v/%v: %w", op.collection, op.resource, err)
+		}
+		j.Writes = append(j.Writes, journalEntry{
+			Collection: op.collection,
+			Resource:   op.resource,
+			Temp:       tmpPath,
+			Path:       d.recordPath(op.collection, op.resource),
+		})
+		dirs[filepath.Dir(tmpPath)] = true
+	}
+
+	if d.dryRun {
+		for _, op := range deletes {
+			d.wouldDelete(op.collection, []string{op.resource})
+		}
+		deletes = nil
+	}
+	for _, op := range deletes {
+		j.Deletes = append(j.Deletes, journalEntry{Collection: op.collection, Resource: op.resource})
+	}
+
+	// the staged records must be on disk before the journal points at them
+	for dir := range dirs {
+		if err := d.fs.SyncDir(dir); err != nil {
+			discard()
+			return err
+		}
+	}
+
+	path, err := d.writeJournal(j)
+	if err != nil {
+		discard()
+		return err
+	}
+
+	if err := d.rollForward(j); err != nil {
+		return fmt.Errorf("unable to apply transaction, %v is left to finish it: %w", path, err)
+	}
+
+	// and the renames before the journal goes
+	for _, collection := range collections {
+		if err := d.fs.SyncDir(filepath.Join(d.dir, collection)); err != nil {
+			return fmt.Errorf("unable to apply transaction, %v is left to finish it: %w", path, err)
+		}
+	}
+
+	if err := d.fs.Remove(path); err != nil {
+		return err
+	}
+	if d.sync {
+		return d.fs.SyncDir(d.dir)
+	}
+	return nil
+}
+
+// writeJournal makes j durable in the database root and returns its path.
+func (d *Driver) writeJournal(j journal) (string, error) {
+	b, err := json.Marshal(j)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(d.dir, fmt.Sprintf("%s%d-%d", journalPrefix, os.Getpid(), d.tempSeq.Add(1)))
+	if err := d.fs.WriteFile(path+".tmp", b, d.filePerm, true); err != nil {
+		d.fs.Remove(path + ".tmp")
+		return "", err
+	}
+	if err := d.fs.Rename(path+".tmp", path); err != nil {
+		d.fs.Remove(path + ".tmp")
+		return "", err
+	}
+	if err := d.fs.SyncDir(d.dir); err != nil {
+		d.fs.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// rollForward applies a journal. It can be run again on a journal that was
+// partly applied: records already renamed into place, or already deleted,
+// are skipped.
+func (d *Driver) rollForward(j journal) error {
+	for _, w := range j.Writes {
+		if _, err := d.fs.Stat(w.Temp); os.IsNotExist(err) {
+			continue
+		}
+		if err := d.install(w.Collection, w.Resource, w.Temp, w.Path); err != nil {
+			return err
+		}
+	}
+
+	for _, del := range j.Deletes {
+		if _, err := d.findRecord(del.Collection, del.Resource); err != nil {
+			continue
+		}
+
+		var err error
+		if d.softDelete {
+			err = d.trashRecord(del.Collection, del.Resource)
+		} else {
+			err = d.removeRecord(del.Collection, del.Resource)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverJournals finishes the transactions a crash interrupted after
+// their journals were written. Journals that were never completed belong
+// to transactions that never took effect and are just removed; Vacuum
+// cleans up their staged records.
+func (d *Driver) recoverJournals() error {
+	entries, err := d.fs.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !strings.HasPrefix(name, journalPrefix) {
+			continue
+		}
+
+		path := filepath.Join(d.dir, name)
+		if strings.HasSuffix(name, ".tmp") {
+			if err := d.fs.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+
+		b, err := d.fs.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var j journal
+		if err := json.Unmarshal(b, &j); err != nil {
+			return fmt.Errorf("corrupt transaction journal %v: %w", path, err)
+		}
+
+		if err := d.rollForward(j); err != nil {
+			return fmt.Errorf("unable to recover transaction from %v: %w", path, err)
+		}
+		if err := d.fs.Remove(path); err != nil {
+			return err
+		}
+		d.logger().Info("Recovered transaction from %v\n", path)
+	}
+	return nil
+}
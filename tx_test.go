@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTransactionRollsBack(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	if err := d.Write("users", "john", "john"); err != nil {
+		t.Fatal(err)
+	}
+
+	boom := errors.New("boom")
+	err := d.Transaction(func(tx *Tx) error {
+		if err := tx.Write("users", "mary", "mary"); err != nil {
+			return err
+		}
+		if err := tx.Delete("users", "john"); err != nil {
+			return err
+		}
+		return boom
+	})
+	if !errors.Is(err, boom) {
+		t.Fatalf("Transaction = %v, want fn's error", err)
+	}
+
+	// a delete of a missing record fails the whole transaction
+	err = d.Transaction(func(tx *Tx) error {
+		if err := tx.Write("users", "mary", "mary"); err != nil {
+			return err
+		}
+		return tx.Delete("users", "nobody")
+	})
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Transaction deleting a missing record = %v, want ErrNotFound", err)
+	}
+
+	var v string
+	if err := d.Read("users", "john", &v); err != nil || v != "john" {
+		t.Errorf("Read(john) = %q, %v, want the queued delete undone", v, err)
+	}
+	if err := d.Read("users", "mary", &v); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Read(mary) = %v, want the queued write undone", err)
+	}
+	if got := strings.Join(files(t, d.dir), ","); got != "users/john.json" {
+		t.Errorf("files = %v, want no staged records or journals left", got)
+	}
+}
+
+func TestTransactionCommits(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	if err := d.Write("users", "john", "john"); err != nil {
+		t.Fatal(err)
+	}
+	err := d.Transaction(func(tx *Tx) error {
+		if err := tx.Write("users", "mary", "mary"); err != nil {
+			return err
+		}
+		if err := tx.Write("orders", "1", "one"); err != nil {
+			return err
+		}
+		return tx.Delete("users", "john")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.Join(files(t, d.dir), ","); got != "orders/1.json,users/mary.json" {
+		t.Errorf("files = %v, want every change applied and the journal gone", got)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// vacuumGrace is how old a temp file must be before Vacuum treats it as
+// left behind by an interrupted write rather than one still in progress.
+const vacuumGrace = 10 * time.Minute
+
+// Vacuum removes the temp files interrupted writes leave behind anywhere in
+// the database, and in Options.TempDir, and returns how many it removed. It
+// is safe to run while the database is in use: temp files younger than ten
+// minutes are assumed to belong to writes still in progress and are left
+// alone.
+func (d *Driver) Vacuum() (int, error) {
+	if err := d.checkOpen(); err != nil {
+		return 0, err
+	}
+
+	removed, err := d.vacuum(d.dir, "")
+	if err != nil || d.tempDir == "" {
+		return removed, err
+	}
+
+	n, err := d.vacuum(d.tempDir, tempPrefix)
+	return removed + n, err
+}
+
+// vacuum removes the old temp files below root whose names start with
+// prefix.
+func (d *Driver) vacuum(root, prefix string) (int, error) {
+	cutoff := time.Now().Add(-vacuumGrace)
+	removed := 0
+	err := d.walk(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// a directory removed while we walk it has nothing left to clean
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if !entry.Type().IsRegular() || !strings.HasPrefix(entry.Name(), prefix) || !strings.HasSuffix(entry.Name(), ".tmp") {
+			return nil
+		}
+
+		fi, err := entry.Info()
+		if err != nil || fi.ModTime().After(cutoff) {
+			return nil
+		}
+
+		if err := d.fs.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		d.logger().Debug("Vacuum removed %v\n", path)
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+// RepairCollection rebuilds a collection's derived data from the records
+// on disk, for when files have been edited by hand or the data has drifted:
+// every index is rebuilt, cached copies are dropped, and the Insert counter
+// is moved up past the highest numeric ID in use. The counter is never
+// moved down, so IDs already handed out are not reused.
+func (d *Driver) RepairCollection(collection string) error {
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+
+	if collection == "" {
+		return fmt.Errorf("%w - unable to repair collection!", ErrMissingCollection)
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	files, _, err := d.recordFiles(collection)
+	if err != nil {
+		return err
+	}
+
+	if d.cache != nil {
+		d.cache.removePrefix(cacheKey(collection, ""))
+	}
+
+	if err := d.repairSeq(collection, files); err != nil {
+		return err
+	}
+
+	return d.rebuildIndexes(collection)
+}
+
+// repairSeq moves the Insert counter past the highest numeric ID among
+// files. A counter that can't be read is replaced.
+func (d *Driver) repairSeq(collection string, files []string) error {
+	var highest uint64
+	for _, file := range files {
+		resource, _ := d.resourceName(file)
+		if id, err := strconv.ParseUint(resource, 10, 64); err == nil && id > highest {
+			highest = id
+		}
+	}
+
+	seq, err := d.readSeq(collection)
+	if err == nil && seq >= highest {
+		return nil
+	}
+	if err != nil {
+		d.logger().Warn("Replacing unreadable counter of %v: %v\n", collection, err)
+	}
+	return d.writeSeq(collection, highest)
+}
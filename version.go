@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// versionExt names the sidecar file holding a record's version.
+const versionExt = ".ver"
+
+// WriteIfVersion writes a record only if its current version is
+// expectedVersion, and returns its new version, one higher. Otherwise it
+// writes nothing and fails with ErrVersionConflict. Read a record's version
+// with ReadVersion or Version, change the record, then write it back with
+// that version: if anyone else wrote it in between, the conflict is
+// reported instead of their change being lost.
+//
+// Records are versioned from their first WriteIfVersion on; after that
+// every write, of any kind, bumps the version. A missing record, or one
+// that has never been written with WriteIfVersion, is at version 0.
+func (d *Driver) WriteIfVersion(collection, resource string, v interface{}, expectedVersion int) (int, error) {
+	if err := d.validate(collection, resource); err != nil {
+		return 0, err
+	}
+
+	unlock := d.lockRecord(collection, resource, true)
+	defer unlock()
+
+	current, err := d.version(collection, resource)
+	if err != nil {
+		return 0, err
+	}
+	if current != expectedVersion {
+		return 0, fmt.Errorf("%w: %v/%v is at version %d, not %d", ErrVersionConflict, collection, resource, current, expectedVersion)
+	}
+
+	if _, err := d.write(collection, resource, v); err != nil {
+		return 0, err
+	}
+
+	// commit has already bumped a versioned record; start the others at 1
+	if current == 0 {
+		if err := d.setVersion(collection, resource, 1); err != nil {
+			return 0, err
+		}
+	}
+	return current + 1, nil
+}
+
+// Version returns a record's current version; see WriteIfVersion.
+func (d *Driver) Version(collection, resource string) (int, error) {
+	if err := d.validate(collection, resource); err != nil {
+		return 0, err
+	}
+
+	unlock := d.lockRecord(collection, resource, false)
+	defer unlock()
+
+	return d.version(collection, resource)
+}
+
+// ReadVersion is Read but also returns the version of the record it read,
+// ready to be passed to WriteIfVersion. Both are read under one lock, so
+// they always agree.
+func (d *Driver) ReadVersion(collection, resource string, v interface{}) (int, error) {
+	if err := d.validate(collection, resource); err != nil {
+		return 0, err
+	}
+
+	// expired records are removed once the read lock is released
+	var expired []string
+	defer func() { d.dropExpired(collection, expired) }()
+
+	unlock := d.lockRecord(collection, resource, false)
+	defer unlock()
+
+	var raw []byte
+	var err error
+	raw, expired, err = d.readLocked(collection, resource)
+	if err != nil {
+		return 0, err
+	}
+
+	version, err := d.version(collection, resource)
+	if err != nil {
+		return 0, err
+	}
+	return version, d.config(collection).codec.Unmarshal(raw, v)
+}
+
+func (d *Driver) versionPath(collection, resource string) string {
+	return filepath.Join(d.dir, collection, d.canonical(resource)+versionExt)
+}
+
+// version reads a record's version, 0 if it is missing or unversioned. The
+// caller must hold the record's lock.
+func (d *Driver) version(collection, resource string) (int, error) {
+	if _, err := d.findRecord(collection, resource); err != nil {
+		// expired records count as missing
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	b, err := d.fs.ReadFile(d.versionPath(collection, resource))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("unable to read version of %v/%v: %w", collection, resource, err)
+	}
+	return n, nil
+}
+
+// bumpVersion increments the version of a versioned record after a write.
+// The caller must hold the record's lock.
+func (d *Driver) bumpVersion(collection, resource string) error {
+	b, err := d.fs.ReadFile(d.versionPath(collection, resource))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return fmt.Errorf("unable to read version of %v/%v: %w", collection, resource, err)
+	}
+	return d.setVersion(collection, resource, n+1)
+}
+
+func (d *Driver) setVersion(collection, resource string, n int) error {
+	path := d.versionPath(collection, resource)
+	b := []byte(strconv.Itoa(n) + "\n")
+
+	if err := d.fs.WriteFile(path+".tmp", b, d.config(collection).filePerm, d.sync); err != nil {
+		return err
+	}
+	return d.fs.Rename(path+".tmp", path)
+}
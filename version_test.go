@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestWriteIfVersion(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	if n, err := d.Version("users", "john"); err != nil || n != 0 {
+		t.Fatalf("Version of a missing record = %d, %v, want 0", n, err)
+	}
+	n, err := d.WriteIfVersion("users", "john", "v1", 0)
+	if err != nil || n != 1 {
+		t.Fatalf("WriteIfVersion(0) = %d, %v, want 1", n, err)
+	}
+
+	// a second writer holding the same version loses
+	if _, err := d.WriteIfVersion("users", "john", "stale", 0); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("WriteIfVersion with a stale version = %v, want ErrVersionConflict", err)
+	}
+	var v string
+	if n, err := d.ReadVersion("users", "john", &v); err != nil || n != 1 || v != "v1" {
+		t.Errorf("ReadVersion = %d, %q, %v, want the losing write discarded", n, v, err)
+	}
+
+	// plain writes bump a versioned record too
+	if err := d.Write("users", "john", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.WriteIfVersion("users", "john", "stale", 1); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("WriteIfVersion after a plain Write = %v, want ErrVersionConflict", err)
+	}
+	if n, err := d.WriteIfVersion("users", "john", "v3", 2); err != nil || n != 3 {
+		t.Errorf("WriteIfVersion(2) = %d, %v, want 3", n, err)
+	}
+}
+
+func TestReadVersionDuringWrites(t *testing.T) {
+	d := newTestDriver(t, nil)
+
+	if _, err := d.WriteIfVersion("counters", "hits", 1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// each write stores the version it creates, so a read of one version
+	// must find the matching record
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 1; ; n++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := d.WriteIfVersion("counters", "hits", n+1, n); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		var v int
+		n, err := d.ReadVersion("counters", "hits", &v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != n {
+			t.Fatalf("ReadVersion = %d for a record holding %d", n, v)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Op is the kind of change an Event reports.
+type Op int
+
+const (
+	OpWrite Op = iota + 1
+	OpDelete
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpWrite:
+		return "write"
+	case OpDelete:
+		return "delete"
+	}
+	return fmt.Sprintf("Op(%d)", int(op))
+}
+
+// Event describes a change to a collection. Resource is empty when the
+// whole collection was removed.
+type Event struct {
+	Op         Op
+	Collection string
+	Resource   string
+	Time       time.Time
+}
+
+// watchBuffer is how many events a watcher may fall behind by before
+// further events for it are dropped.
+const watchBuffer = 64
+
+// Watch subscribes to changes in a collection. An event is sent after every
+// successful write or delete in it. Events are buffered; a watcher that falls
+// too far behind misses events rather than stalling writers. Calling the
+// returned func ends the subscription and closes the channel, as does Close.
+func (d *Driver) Watch(collection string) (<-chan Event, func(), error) {
+	if err := d.checkOpen(); err != nil {
+		return nil, nil, err
+	}
+
+	if collection == "" {
+		return nil, nil, fmt.Errorf("%w - unable to watch", ErrMissingCollection)
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return nil, nil, err
+	}
+
+	ch := make(chan Event, watchBuffer)
+
+	d.watchMu.Lock()
+	if d.watchers[collection] == nil {
+		d.watchers[collection] = make(map[chan Event]struct{})
+	}
+	d.watchers[collection][ch] = struct{}{}
+	d.watchMu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			d.watchMu.Lock()
+			defer d.watchMu.Unlock()
+
+			// Close may already have closed it
+			if _, ok := d.watchers[collection][ch]; !ok {
+				return
+			}
+			delete(d.watchers[collection], ch)
+			if len(d.watchers[collection]) == 0 {
+				delete(d.watchers, collection)
+			}
+			close(ch)
+		})
+	}
+	return ch, cancel, nil
+}
+
+// notify sends an event to the collection's watchers.
+func (d *Driver) notify(op Op, collection, resource string) {
+	d.watchMu.Lock()
+	defer d.watchMu.Unlock()
+
+	if len(d.watchers[collection]) == 0 {
+		return
+	}
+
+	ev := Event{Op: op, Collection: collection, Resource: resource, Time: time.Now()}
+	for ch := range d.watchers[collection] {
+		select {
+		case ch <- ev:
+		default:
+			d.logger().Warn("Dropping %v event for %v/%v: watcher is not keeping up\n", op, collection, resource)
+		}
+	}
+}